@@ -0,0 +1,469 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"go.arpabet.com/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Backup writes entries modified at or after the since watermark by the configured serializer and returns
+// the watermark for the next incremental backup, since zero produces a full dump. Removed keys are not tracked by incremental backups.
+// The watermark is never zero and stays the same for repeated backups until the next write.
+// Errors are matched by ErrBackup and keep the cause.
+func (t *inmemoryStorage) Backup(w io.Writer, since uint64) (uint64, error) {
+	watermark, err := t.backup(w, since)
+	if err != nil {
+		return 0, &backupError{kind: ErrBackup, name: t.name, err: err}
+	}
+	return watermark, nil
+}
+
+func (t *inmemoryStorage) backup(w io.Writer, since uint64) (uint64, error) {
+
+	// writers take modification numbers under the shared view lock, so all entries below the watermark are in the cache
+	t.view.Lock()
+	watermark := atomic.LoadUint64(&t.modSeq) + 1
+	items := t.shards.items()
+	t.view.Unlock()
+
+	var entries []BackupEntry
+
+	now := t.conf.Clock.Now()
+	for key, item := range items {
+
+		if !t.owns(key) {
+			continue
+		}
+
+		e, ok := t.live(item.Object, now)
+		if !ok || e.Modified < since || e.Modified >= watermark {
+			continue
+		}
+
+		be, err := t.backupEntry(key, e, now)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, be)
+	}
+
+	if t.conf.BackupCipher == nil {
+		if err := encodeEntries(t.conf.Serializer, w, entries); err != nil {
+			return 0, err
+		}
+		return watermark, nil
+	}
+
+	var buf bytes.Buffer
+	if err := encodeEntries(t.conf.Serializer, &buf, entries); err != nil {
+		return 0, err
+	}
+	sealed, err := t.conf.BackupCipher.Seal(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(sealed); err != nil {
+		return 0, err
+	}
+
+	return watermark, nil
+}
+
+// Restore replays full or incremental backup on top of existing contents, restored entries overwrite existing ones
+func (t *inmemoryStorage) Restore(src io.Reader) error {
+	_, err := t.RestoreCount(src)
+	return err
+}
+
+// RestoreCount is Restore returning the number of loaded entries, malformed or truncated streams are reported by ErrCorruptBackup.
+// Errors are matched by ErrRestore and keep the cause
+func (t *inmemoryStorage) RestoreCount(src io.Reader) (int, error) {
+	cnt, err := t.restore(src)
+	if err != nil {
+		return cnt, &backupError{kind: ErrRestore, name: t.name, err: err}
+	}
+	return cnt, nil
+}
+
+func (t *inmemoryStorage) restore(src io.Reader) (int, error) {
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+
+	if t.conf.BackupCipher != nil {
+		sealed, err := ioutil.ReadAll(src)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := t.conf.BackupCipher.Open(sealed)
+		if err != nil {
+			return 0, err
+		}
+		src = bytes.NewReader(plain)
+	}
+
+	r := bufio.NewReader(src)
+
+	entries, err := decodeEntries(t.conf.Serializer, r)
+	if err == errLegacyDump {
+		// backups made before incremental support are plain go-cache dumps, existing entries are kept like cache.Load does
+		legacy, err := t.legacyEntries(r)
+		if err != nil {
+			return 0, corruptBackup(err)
+		}
+		cnt := 0
+		for i := range legacy {
+			written, err := t.restoreEntry(&legacy[i], false)
+			if err != nil {
+				return cnt, err
+			}
+			if written {
+				cnt++
+			}
+		}
+		return cnt, nil
+	}
+	if err != nil {
+		return 0, corruptBackup(err)
+	}
+
+	for i := range entries {
+		if _, err := t.restoreEntry(&entries[i], true); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// legacyEntries reads a go-cache dump as entries with their remaining ttl, expired items are skipped
+func (t *inmemoryStorage) legacyEntries(r io.Reader) ([]BackupEntry, error) {
+	tmp := cache.New(cache.NoExpiration, 0)
+	if err := tmp.Load(r); err != nil {
+		return nil, err
+	}
+	now := t.conf.Clock.Now()
+	var entries []BackupEntry
+	for key, item := range tmp.Items() {
+		e, ok := asEntry(item.Object)
+		if !ok || e.expired(now) {
+			continue
+		}
+		value, err := t.decode(e)
+		if err != nil {
+			return nil, err
+		}
+		left := e.ttl(now)
+		if item.Expiration > 0 {
+			left = time.Until(time.Unix(0, item.Expiration))
+		}
+		entries = append(entries, BackupEntry{Key: []byte(key), Value: value, Ttl: ttlSeconds(left), Version: e.Version, Meta: e.Meta})
+	}
+	return entries, nil
+}
+
+// loadFile restores the backup from the file even in read-only mode, a missing file is not an error
+func (t *inmemoryStorage) loadFile(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	readOnly := atomic.LoadInt32(&t.readOnly) == 1
+	if readOnly {
+		t.SetReadOnly(false)
+		defer t.SetReadOnly(true)
+	}
+	return t.Restore(f)
+}
+
+// autoSave writes the periodic backup and passes its error to the hook
+func (t *inmemoryStorage) autoSave() {
+	if err := t.saveFile(t.conf.AutoBackupPath); err != nil && t.conf.OnBackupError != nil {
+		t.conf.OnBackupError(err)
+	}
+}
+
+// saveFile writes the full backup to a temporary file in the same directory and renames it to the path,
+// so the file is either the previous or the new complete backup
+func (t *inmemoryStorage) saveFile(path string) error {
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Backup(f, 0); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// backupError tells the storage where backup or restore failed, errors.Is matches both the kind and the cause
+type backupError struct {
+	kind error
+	name string
+	err  error
+}
+
+func (e *backupError) Error() string {
+	return fmt.Sprintf("inmemorystorage: %v for %q: %v", e.kind, e.name, e.err)
+}
+
+func (e *backupError) Unwrap() error {
+	return e.err
+}
+
+func (e *backupError) Is(target error) bool {
+	return target == e.kind
+}
+
+// corruptBackup replaces decoder errors by ErrCorruptBackup keeping the cause in the message
+func corruptBackup(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: stream is truncated", ErrCorruptBackup)
+	}
+	return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+}
+
+// backupEntry converts the entry to the record of backup streams with plain value and remaining ttl
+func (t *inmemoryStorage) backupEntry(key string, e *entry, now time.Time) (BackupEntry, error) {
+	value, err := t.decode(e)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	return BackupEntry{
+		Key:     []byte(t.userKey(key)),
+		Value:   value,
+		Ttl:     ttlSeconds(e.ttl(now)),
+		Version: e.Version,
+		Meta:    copyMeta(e.Meta),
+	}, nil
+}
+
+// restoreEntry puts the entry keeping its remaining ttl and tags and reports if it was written, existing keys are replaced only with overwrite
+func (t *inmemoryStorage) restoreEntry(re *BackupEntry, overwrite bool) (bool, error) {
+
+	ttl := cache.NoExpiration
+	if re.Ttl > 0 {
+		ttl = time.Second * time.Duration(re.Ttl)
+	}
+
+	k := t.rawKey(re.Key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !overwrite {
+		if _, ok := t.lookup(k); ok {
+			return false, nil
+		}
+	}
+
+	version := t.versionOf(k) + 1
+	if re.Version > version {
+		version = re.Version
+	}
+	if err := t.putMeta(k, re.Value, version, ttl, copyMeta(re.Meta)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ExportJSON writes all entries with their tags sorted by key as JSON array independently of the configured serializer
+func (t *inmemoryStorage) ExportJSON(w io.Writer) error {
+
+	list := t.matchEntries(t.ns, func(string) bool {
+		return true
+	})
+	t.sortEntries(list, false)
+
+	entries := make([]BackupEntry, 0, len(list))
+	now := t.conf.Clock.Now()
+	for _, ke := range list {
+		if ke.e.expired(now) {
+			continue
+		}
+		be, err := t.backupEntry(ke.key, ke.e, now)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, be)
+	}
+
+	return JSONSerializer{}.EncodeEntries(w, entries)
+}
+
+// ImportJSON merges entries written by ExportJSON onto existing contents
+func (t *inmemoryStorage) ImportJSON(r io.Reader) error {
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	entries, err := JSONSerializer{}.DecodeEntries(r)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		if _, err := t.restoreEntry(&entries[i], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge imports entries of the other storage keeping their remaining ttl, existing keys are replaced only with overwrite
+func (t *inmemoryStorage) Merge(other storage.ManagedStorage, overwrite bool) error {
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	var restoreErr error
+	err := other.EnumerateRaw(nil, nil, 0, false, func(re *storage.RawEntry) bool {
+		_, restoreErr = t.restoreEntry(&BackupEntry{Key: re.Key, Value: re.Value, Ttl: re.Ttl, Version: re.Version}, overwrite)
+		return restoreErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return restoreErr
+}
+
+// CopyPrefixTo writes entries with the prefix to the other storage keeping their keys and returns their number,
+// with preserveTTL the remaining ttl is kept, otherwise entries are written without ttl. The source is not modified
+func (t *inmemoryStorage) CopyPrefixTo(dst storage.ManagedStorage, prefix []byte, preserveTTL bool) (int, error) {
+
+	cnt := 0
+	var setErr error
+	err := t.EnumerateRaw(prefix, nil, 0, false, func(re *storage.RawEntry) bool {
+		ttl := storage.NoTTL
+		if preserveTTL && re.Ttl > 0 {
+			ttl = re.Ttl
+		}
+		if setErr = dst.SetRaw(re.Key, re.Value, ttl); setErr != nil {
+			return false
+		}
+		cnt++
+		return true
+	})
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, setErr
+}
+
+// BackupStream writes all entries in the format of GobSerializer encoding them one at a time, so large stores are not copied in memory.
+// The configured serializer and cipher are not applied, the stream is read by RestoreStream or by Restore with the default serializer
+func (t *inmemoryStorage) BackupStream(w io.Writer) error {
+	if err := t.backupStream(w); err != nil {
+		return &backupError{kind: ErrBackup, name: t.name, err: err}
+	}
+	return nil
+}
+
+func (t *inmemoryStorage) backupStream(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(backupMagic); err != nil {
+		return err
+	}
+
+	// only keys are collected, values are encoded while they are looked up
+	var keys []string
+	t.lru.forEach(func(k string) bool {
+		keys = append(keys, k)
+		return true
+	})
+
+	enc := gob.NewEncoder(bw)
+	now := t.conf.Clock.Now()
+	for _, k := range keys {
+		e, ok := t.lookup(k)
+		if !ok {
+			continue
+		}
+		be, err := t.backupEntry(k, e, now)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(&be); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// RestoreStream reads entries written by BackupStream one at a time and puts them on top of existing contents
+func (t *inmemoryStorage) RestoreStream(r io.Reader) error {
+	if err := t.restoreStream(r); err != nil {
+		return &backupError{kind: ErrRestore, name: t.name, err: err}
+	}
+	return nil
+}
+
+func (t *inmemoryStorage) restoreStream(r io.Reader) error {
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(backupMagic)); err != nil || !bytes.Equal(magic, backupMagic) {
+		return fmt.Errorf("%w: stream does not start with the backup header", ErrCorruptBackup)
+	}
+	if _, err := br.Discard(len(backupMagic)); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(br)
+	for {
+		var be BackupEntry
+		if err := dec.Decode(&be); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return corruptBackup(err)
+		}
+		if _, err := t.restoreEntry(&be, true); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMergeOverwrite(t *testing.T) {
+
+	for _, overwrite := range []bool{false, true} {
+
+		dst := newTestStorage(t)
+		src := newTestStorage(t)
+		if err := dst.SetRaw([]byte("shared"), []byte("dst"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := dst.SetRaw([]byte("only-dst"), []byte("dst"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := src.SetRaw([]byte("shared"), []byte("src"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := src.SetRaw([]byte("only-src"), []byte("src"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+
+		if err := dst.Merge(src, overwrite); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+
+		expected := map[string]string{"shared": "dst", "only-dst": "dst", "only-src": "src"}
+		if overwrite {
+			expected["shared"] = "src"
+		}
+		snapshot, err := dst.Snapshot()
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		if len(snapshot) != len(expected) {
+			t.Fatalf("overwrite %v merged %q", overwrite, snapshot)
+		}
+		for key, value := range expected {
+			if string(snapshot[key]) != value {
+				t.Fatalf("overwrite %v: key %q has value %q, expected %q", overwrite, key, snapshot[key], value)
+			}
+		}
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+
+	key := bytes.Repeat([]byte{1}, 32)
+	cipher, err := NewAESGCMCipher(key)
+	if err != nil {
+		t.Fatalf("create cipher: %v", err)
+	}
+
+	src := newTestStorage(t, WithBackupCipher(cipher))
+	if err := src.SetRaw([]byte("secret"), []byte("plaintext value"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := src.Backup(&buf, 0); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("plaintext value")) {
+		t.Fatalf("backup is not encrypted")
+	}
+	sealed := buf.Bytes()
+
+	dst := newTestStorage(t, WithBackupCipher(cipher))
+	if err := dst.Restore(bytes.NewReader(sealed)); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	value, err := dst.GetRaw([]byte("secret"), nil, nil, true)
+	if err != nil || string(value) != "plaintext value" {
+		t.Fatalf("restored %q, %v", value, err)
+	}
+
+	wrong, err := NewAESGCMCipher(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatalf("create cipher: %v", err)
+	}
+	other := newTestStorage(t, WithBackupCipher(wrong))
+	if err := other.Restore(bytes.NewReader(sealed)); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("restore with the wrong key returned %v", err)
+	}
+}
+
+func TestCopyPrefixTo(t *testing.T) {
+
+	src := newTestStorage(t)
+	for i := 0; i < 5; i++ {
+		if err := src.SetRaw([]byte(fmt.Sprintf("copy:%d", i)), []byte(fmt.Sprint(i)), 60); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := src.SetRaw([]byte("skip:0"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	dst := newTestStorage(t)
+	n, err := src.CopyPrefixTo(dst, []byte("copy:"), true)
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if n != 5 || dst.Len() != 5 {
+		t.Fatalf("copied %d entries, destination has %d", n, dst.Len())
+	}
+	for i := 0; i < 5; i++ {
+		var ttl int
+		value, err := dst.GetRaw([]byte(fmt.Sprintf("copy:%d", i)), &ttl, nil, true)
+		if err != nil || string(value) != fmt.Sprint(i) {
+			t.Fatalf("copied value %q, %v", value, err)
+		}
+		if ttl <= 0 || ttl > 60 {
+			t.Fatalf("ttl %d is not preserved", ttl)
+		}
+	}
+	if src.Len() != 6 {
+		t.Fatalf("source changed to %d entries", src.Len())
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestBackupErrorsAreWrapped(t *testing.T) {
+
+	s := newTestStorage(t)
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	_, err := s.Backup(failingWriter{}, 0)
+	if !errors.Is(err, ErrBackup) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("backup returned %v", err)
+	}
+	expected := fmt.Sprintf("inmemorystorage: backup failed for %q: io: read/write on closed pipe", t.Name())
+	if err.Error() != expected {
+		t.Fatalf("message %q, expected %q", err.Error(), expected)
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.Backup(&buf, 0); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-3]
+	err = s.Restore(bytes.NewReader(truncated))
+	if !errors.Is(err, ErrRestore) || !errors.Is(err, ErrCorruptBackup) {
+		t.Fatalf("restore of a truncated stream returned %v", err)
+	}
+	expected = fmt.Sprintf("inmemorystorage: restore failed for %q: backup stream is corrupted: stream is truncated", t.Name())
+	if err.Error() != expected {
+		t.Fatalf("message %q, expected %q", err.Error(), expected)
+	}
+}
+
+// heapSampler is the writer recording the largest heap seen while the stream is written
+type heapSampler struct {
+	writes int
+	peak   uint64
+}
+
+func (w *heapSampler) Write(p []byte) (int, error) {
+	if w.writes%1024 == 0 {
+		// only live objects count, garbage of the encoder is collected first
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > w.peak {
+			w.peak = m.HeapAlloc
+		}
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func TestBackupStreamBoundedMemory(t *testing.T) {
+
+	const entries, valueSize = 20000, 1024
+	s := newTestStorage(t)
+	value := bytes.Repeat([]byte{'v'}, valueSize)
+	for i := 0; i < entries; i++ {
+		if err := s.SetRaw([]byte(fmt.Sprintf("key%06d", i)), value, 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	w := &heapSampler{}
+	if err := s.BackupStream(w); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if grown, limit := int64(w.peak)-int64(base), int64(entries*valueSize/2); grown > limit {
+		t.Fatalf("heap grew by %d bytes during backup of %d bytes, limit %d", grown, entries*valueSize, limit)
+	}
+
+	var buf bytes.Buffer
+	if err := s.BackupStream(&buf); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	dst := newTestStorage(t)
+	if err := dst.RestoreStream(&buf); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if n := dst.Len(); n != entries {
+		t.Fatalf("restored %d entries, expected %d", n, entries)
+	}
+	restored, err := dst.GetRaw([]byte("key012345"), nil, nil, true)
+	if err != nil || !bytes.Equal(restored, value) {
+		t.Fatalf("restored value of %d bytes, %v", len(restored), err)
+	}
+}
+
+func TestStartupLoadFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "inmemorystorage")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup")
+
+	src := newTestStorage(t)
+	fillKeys(t, src, 10)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := src.Backup(f, 0); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	dst := newTestStorage(t, WithStartupLoadFile(path))
+	expected, _ := src.Snapshot()
+	loaded, _ := dst.Snapshot()
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("loaded %d entries, expected %d", len(loaded), len(expected))
+	}
+
+	// a missing file means a fresh start
+	empty := newTestStorage(t, WithStartupLoadFile(filepath.Join(dir, "missing")))
+	if n := empty.Len(); n != 0 {
+		t.Fatalf("%d entries loaded from a missing file", n)
+	}
+}
+
+func TestAutoBackup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "inmemorystorage")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup")
+
+	errs := make(chan error, 1)
+	s := newTestStorage(t, WithAutoBackup(path, 10*time.Millisecond), WithBackupErrorHook(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	fillKeys(t, s, 10)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dst := newTestStorage(t)
+		if f, err := os.Open(path); err == nil {
+			err = dst.Restore(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+		}
+		if dst.Len() == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backup file with all entries did not appear")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Destroy(); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("auto backup failed: %v", err)
+	default:
+	}
+}
+
+func TestRestoreLegacyDumpInNamespace(t *testing.T) {
+
+	legacy := cache.New(cache.NoExpiration, 0)
+	legacy.Set("k", []byte("legacy"), cache.NoExpiration)
+	legacy.Set("kept", []byte("legacy"), cache.NoExpiration)
+	var dump bytes.Buffer
+	if err := legacy.Save(&dump); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	c := OpenDatabase()
+	s := FromCache("tenant", c, WithNamespace("tenant")).(*inmemoryStorage)
+	defer s.Destroy()
+	if err := s.SetRaw([]byte("kept"), []byte("existing"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	cnt, err := s.RestoreCount(&dump)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if cnt != 1 {
+		t.Fatalf("restored %d entries, expected 1", cnt)
+	}
+	value, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(value) != "legacy" {
+		t.Fatalf("get restored key: %q, %v", value, err)
+	}
+	if value, _ := s.GetRaw([]byte("kept"), nil, nil, true); string(value) != "existing" {
+		t.Fatalf("existing key is replaced by %q", value)
+	}
+	if _, found := c.Get("k"); found {
+		t.Fatalf("legacy key is restored outside of the namespace")
+	}
+}
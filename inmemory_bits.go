@@ -0,0 +1,111 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxBitOffset bounds the value grown by SetBitRaw to 512MiB when MaxValueSize is not set
+const maxBitOffset = 1<<32 - 1
+
+// SetBitRaw sets or clears the bit at the offset of the value treated as a bit array and returns the previous bit,
+// bit zero is the most significant bit of the first byte. The value is extended by zero bytes as needed and keeps its ttl and tags,
+// an absent key is created with the default expiration. Offsets making the value larger than MaxValueSize or maxBitOffset are rejected
+// with ErrValueTooLarge before the value is allocated
+func (t *inmemoryStorage) SetBitRaw(key []byte, offset int, value bool) (prev bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SetBitRaw", key, time.Now(), &err)
+	}
+
+	if offset < 0 {
+		return false, fmt.Errorf("negative bit offset %d", offset)
+	}
+	if int64(offset) > maxBitOffset || (t.conf.MaxValueSize > 0 && offset/8 >= t.conf.MaxValueSize) {
+		return false, fmt.Errorf("%w: bit offset %d", ErrValueTooLarge, offset)
+	}
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var bits []byte
+	var version int64
+	var meta map[string]string
+	ttl := t.ttlOrDefault(0)
+	if e, ok := t.lookup(k); ok {
+		v, err := t.decode(e)
+		if err != nil {
+			return false, err
+		}
+		bits = v
+		version = e.Version
+		meta = e.Meta
+		if ttl = e.ttl(t.conf.Clock.Now()); ttl == 0 {
+			// expires right now, keep it expiring
+			ttl = time.Nanosecond
+		}
+	}
+
+	idx, mask := offset/8, byte(0x80)>>uint(offset%8)
+	size := len(bits)
+	if idx >= size {
+		size = idx + 1
+	}
+	// the stored value is never modified in place, readers may hold it
+	updated := make([]byte, size)
+	copy(updated, bits)
+
+	prev = updated[idx]&mask != 0
+	if value {
+		updated[idx] |= mask
+	} else {
+		updated[idx] &^= mask
+	}
+
+	if err := t.putMeta(k, updated, version+1, ttl, meta); err != nil {
+		return false, err
+	}
+	return prev, nil
+}
+
+// GetBitRaw returns the bit at the offset of the value treated as a bit array, bits beyond the value and of absent keys are zero
+func (t *inmemoryStorage) GetBitRaw(key []byte, offset int) (bit bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("GetBitRaw", key, time.Now(), &err)
+	}
+
+	if offset < 0 {
+		return false, fmt.Errorf("negative bit offset %d", offset)
+	}
+
+	e, ok := t.lookup(t.rawKey(key))
+	if !ok {
+		return false, nil
+	}
+	if e.Compressed {
+		value, err := t.decode(e)
+		if err != nil {
+			return false, err
+		}
+		return bitAt(value, offset), nil
+	}
+	return bitAt(e.Value, offset), nil
+}
+
+func bitAt(bits []byte, offset int) bool {
+	idx := offset / 8
+	if idx >= len(bits) {
+		return false
+	}
+	return bits[idx]&(byte(0x80)>>uint(offset%8)) != 0
+}
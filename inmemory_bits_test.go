@@ -0,0 +1,49 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBitsAcrossBytes(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	for _, offset := range []int{0, 7, 8, 15, 17} {
+		if prev, err := s.SetBitRaw([]byte("bits"), offset, true); prev || err != nil {
+			t.Fatalf("set bit %d: previous %v, %v", offset, prev, err)
+		}
+	}
+	value, err := s.GetRaw([]byte("bits"), nil, nil, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if expected := []byte{0x81, 0x81, 0x40}; string(value) != string(expected) {
+		t.Fatalf("value %x, expected %x", value, expected)
+	}
+
+	if prev, err := s.SetBitRaw([]byte("bits"), 8, false); !prev || err != nil {
+		t.Fatalf("clear bit 8: previous %v, %v", prev, err)
+	}
+	for offset, expected := range map[int]bool{0: true, 7: true, 8: false, 15: true, 16: false, 17: true, 1000: false} {
+		if bit, err := s.GetBitRaw([]byte("bits"), offset); bit != expected || err != nil {
+			t.Fatalf("bit %d is %v, %v", offset, bit, err)
+		}
+	}
+
+	if _, err := s.SetBitRaw([]byte("bits"), -1, true); err == nil {
+		t.Fatalf("negative offset is accepted")
+	}
+
+	limited := newTestStorage(t, WithMaxValueSize(2))
+	if _, err := limited.SetBitRaw([]byte("bits"), 15, true); err != nil {
+		t.Fatalf("set the last bit within the limit: %v", err)
+	}
+	if _, err := limited.SetBitRaw([]byte("bits"), 16, true); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("offset beyond the limit returned %v", err)
+	}
+}
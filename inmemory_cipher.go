@@ -0,0 +1,56 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+)
+
+// BackupCipher encrypts backup streams at rest
+type BackupCipher interface {
+	Seal(plain []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher creates AES-GCM backup cipher, the key must be 16, 24 or 32 bytes long
+func NewAESGCMCipher(key []byte) (BackupCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMCipher{aead: aead}, nil
+}
+
+// Seal returns random nonce followed by the encrypted data
+func (t *aesGCMCipher) Seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize()+len(plain)+t.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (t *aesGCMCipher) Open(sealed []byte) ([]byte, error) {
+	n := t.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrDecryption
+	}
+	plain, err := t.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plain, nil
+}
@@ -0,0 +1,35 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClockDrivesExpiration(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 5); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	clock.Advance(4 * time.Second)
+	var ttl int
+	if _, err := s.GetRaw([]byte("k"), &ttl, nil, true); err != nil {
+		t.Fatalf("get before expiration: %v", err)
+	}
+	if ttl != 1 {
+		t.Fatalf("ttl %d, expected 1", ttl)
+	}
+
+	clock.Advance(2 * time.Second)
+	if _, err := s.GetRaw([]byte("k"), nil, nil, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get after expiration returned %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compressor transparently compresses stored values
+type Compressor interface {
+	Compress(value []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// NoCompressor is the default compressor keeping values as is
+type NoCompressor struct{}
+
+func (NoCompressor) Compress(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (NoCompressor) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// GzipCompressor compresses values with gzip at the given level, zero means the default level
+type GzipCompressor struct {
+	Level int
+}
+
+func (c GzipCompressor) Compress(value []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// encode compresses the value for storing, values that do not get smaller are kept as is
+func (t *inmemoryStorage) encode(value []byte) ([]byte, bool, error) {
+	if _, ok := t.conf.Compressor.(NoCompressor); ok || t.conf.Compressor == nil || len(value) == 0 {
+		return value, false, nil
+	}
+	data, err := t.conf.Compressor.Compress(value)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) >= len(value) {
+		return value, false, nil
+	}
+	return data, true, nil
+}
+
+// decode returns the original value of the entry, the stored slice itself only without CopyOnRead
+func (t *inmemoryStorage) decode(e *entry) ([]byte, error) {
+	if !e.Compressed {
+		if t.conf.CopyOnRead && e.Value != nil {
+			value := make([]byte, len(e.Value))
+			copy(value, e.Value)
+			return value, nil
+		}
+		return e.Value, nil
+	}
+	return t.conf.Compressor.Decompress(e.Value)
+}
+
+// plainValue returns the original value of the entry or nil if it can not be decompressed, used for notifications
+func (t *inmemoryStorage) plainValue(e *entry) []byte {
+	value, err := t.decode(e)
+	if err != nil {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,35 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGzipRoundTrip(t *testing.T) {
+
+	plain := newTestStorage(t)
+	compressed := newTestStorage(t, WithCompression(GzipCompressor{}))
+
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	for _, s := range []*inmemoryStorage{plain, compressed} {
+		if err := s.SetRaw([]byte("k"), value, 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	if compressed.SizeBytes() >= plain.SizeBytes()/10 {
+		t.Fatalf("compressed size %d is not much smaller than %d", compressed.SizeBytes(), plain.SizeBytes())
+	}
+
+	read, err := compressed.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !bytes.Equal(read, value) {
+		t.Fatalf("value read back differs")
+	}
+}
@@ -6,16 +6,58 @@ package inmemorystorage
 
 import (
 	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"os"
 	"time"
 )
 
 var (
 	ErrCanceled         = errors.New("operation was canceled")
+	ErrNotCounter       = errors.New("value is not an 8 byte counter")
+	ErrReadOnly         = errors.New("storage is read-only")
+	ErrDecryption       = errors.New("backup decryption failed, wrong key or corrupted data")
+	ErrCorruptBackup    = errors.New("backup stream is corrupted")
+	ErrTypeMismatch     = errors.New("cached object is not a storage entry")
+	ErrBackup           = errors.New("backup failed")
+	ErrRestore          = errors.New("restore failed")
+	ErrNotFound         = fmt.Errorf("entry not found: %w", os.ErrNotExist) // matches os.ErrNotExist returned before
+	ErrInvalidOption    = errors.New("invalid option")
+	ErrKeyTooLong       = errors.New("key is too long")
+	ErrValueTooLarge    = errors.New("value is too large")
+	ErrInvalidName      = errors.New("invalid storage name")
 )
 
 type Config struct {
 	DefaultExpiration time.Duration
 	CleanupInterval   time.Duration
+	MaxEntries        int   // evict entries by EvictionPolicy above this count, zero means unlimited
+	MaxMemoryBytes    int64 // evict entries by EvictionPolicy while they take more bytes by SizeBytes, zero means unlimited
+	OnEvicted         func(key, value []byte, reason EvictionReason)
+	Clock             Clock
+	Shards            int // number of independent caches keys are partitioned across, one by default
+	Serializer        Serializer
+	ReadOnly          bool
+	Compressor        Compressor
+	BackupCipher      BackupCipher // nil means backups are not encrypted
+	InitialCapacity   int          // expected number of entries to presize maps for
+	PrefixIndex       bool         // keep keys sorted to look up prefixes without scanning all keys
+	Namespace         string       // prefix of keys in the cache separated by slash, empty means no prefix
+	SealedInstance    bool         // hide the underlying cache from Instance and Cache
+	Validator         func(key, value []byte) error
+	MetricsHook       func(op string, key []byte, dur time.Duration, err error)
+	KeyComparator     func(a, b []byte) int // order of keys in sorted operations, byte-lexicographic when nil
+	EvictionPolicy    Policy                // entries to evict above MaxEntries or MaxMemoryBytes, PolicyLRU by default
+	TTLJitter         float64               // fraction of ttl randomly added or subtracted on writes, zero disables it
+	CopyOnRead        bool                  // return copies of stored values, true by default
+	CopyOnWrite       bool                  // store copies of written values, true by default
+	StartupLoadFile   string                // backup restored on creation if the file exists
+	AutoBackupPath    string                // file rewritten by periodic backups, empty disables them
+	BackupInterval    time.Duration         // interval of periodic backups to AutoBackupPath
+	OnBackupError     func(err error)       // receives errors of periodic backups
+	MaxKeyLength      int                   // writes of longer keys are rejected, zero means unlimited
+	MaxValueSize      int                   // writes of larger values before compression are rejected, zero means unlimited
+	UniqueName        bool                  // reserve the name in the package registry until Destroy
 }
 
 // Option configures memory storage using the functional options paradigm
@@ -46,10 +88,215 @@ func WithDefaultExpiration(value time.Duration) Option {
 	})
 }
 
+// WithCleanupInterval sets how often expired entries are removed in background, zero or negative value disables the janitor
 func WithCleanupInterval(value time.Duration) Option {
 	return optionFunc(func(opts *Config) {
 		opts.CleanupInterval = value
 	})
 }
 
+func WithMaxEntries(n int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.MaxEntries = n
+	})
+}
+
+// WithMaxMemoryBytes evicts entries while they take more than n bytes by SizeBytes, writes of a single entry taking more are rejected with ErrValueTooLarge
+func WithMaxMemoryBytes(n int64) Option {
+	return optionFunc(func(opts *Config) {
+		opts.MaxMemoryBytes = n
+	})
+}
+
+// WithOnEvicted sets the callback invoked for every entry leaving the storage except DropAll. The callback runs while the evicted key
+// and the key of the operation that caused the eviction are locked, so it must not write them, other keys can be read and written
+func WithOnEvicted(cb func(key, value []byte, reason EvictionReason)) Option {
+	return optionFunc(func(opts *Config) {
+		opts.OnEvicted = cb
+	})
+}
+
+// WithClock replaces the system clock used to expire entries, useful for deterministic tests
+func WithClock(clock Clock) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Clock = clock
+	})
+}
+
+func WithShards(n int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Shards = n
+	})
+}
+
+// WithDefaultTTL sets expiration in seconds for entries written without ttl, zero means no expiration
+func WithDefaultTTL(seconds int) Option {
+	return optionFunc(func(opts *Config) {
+		if seconds > 0 {
+			opts.DefaultExpiration = time.Second * time.Duration(seconds)
+		} else {
+			opts.DefaultExpiration = cache.NoExpiration
+		}
+	})
+}
+
+// WithSerializer sets the format of Backup and Restore streams, gob by default
+func WithSerializer(s Serializer) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Serializer = s
+	})
+}
+
+// WithCompression sets the compressor applied to stored values, size limits account compressed bytes
+func WithCompression(c Compressor) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Compressor = c
+	})
+}
+
+// WithBackupCipher encrypts Backup streams and decrypts Restore streams with the cipher
+func WithBackupCipher(cipher BackupCipher) Option {
+	return optionFunc(func(opts *Config) {
+		opts.BackupCipher = cipher
+	})
+}
+
+// WithInitialCapacity presizes internal maps for n entries to avoid rehashing on bulk load
+func WithInitialCapacity(n int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.InitialCapacity = n
+	})
+}
+
+// WithPrefixIndex maintains a sorted index of keys, so prefix operations visit only matching keys at the cost of slower inserts and removals
+func WithPrefixIndex() Option {
+	return optionFunc(func(opts *Config) {
+		opts.PrefixIndex = true
+	})
+}
+
+// WithNamespace isolates storages sharing a cache by prefixing all keys with the namespace and a slash, keys passed to callbacks
+// are without the prefix. The namespace must not contain slashes, so one namespace is never a prefix of another.
+// Entries expired in the cache itself, like the ones written to it directly with expiration, are reported only to OnEvicted
+// and watchers of the storage created last, because the cache has a single eviction callback
+func WithNamespace(ns string) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Namespace = ns
+	})
+}
+
+// WithSealedInstance makes Instance and Cache return nil, so the underlying cache can not be modified bypassing the storage
+func WithSealedInstance() Option {
+	return optionFunc(func(opts *Config) {
+		opts.SealedInstance = true
+	})
+}
+
+// WithValidator checks every written entry, the write is rejected with the error returned by the validator
+func WithValidator(validate func(key, value []byte) error) Option {
+	return optionFunc(func(opts *Config) {
+		opts.Validator = validate
+	})
+}
+
+// WithMetricsHook calls the hook after every Raw operation with its name, key or prefix, latency and result
+func WithMetricsHook(hook func(op string, key []byte, dur time.Duration, err error)) Option {
+	return optionFunc(func(opts *Config) {
+		opts.MetricsHook = hook
+	})
+}
+
+// WithKeyComparator sets the order of keys used by sorted enumerations, ranges, iterators and FirstKey/LastKey,
+// the comparator returns a negative number, zero or a positive number like bytes.Compare that is the default
+func WithKeyComparator(compare func(a, b []byte) int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.KeyComparator = compare
+	})
+}
+
+// WithEvictionPolicy selects entries evicted when MaxEntries or MaxMemoryBytes is exceeded, PolicyLRU by default
+func WithEvictionPolicy(p Policy) Option {
+	return optionFunc(func(opts *Config) {
+		opts.EvictionPolicy = p
+	})
+}
+
+// WithTTLJitter spreads expirations of entries written with the same ttl by randomly changing it by up to ±fraction, values above 1 are capped
+func WithTTLJitter(fraction float64) Option {
+	return optionFunc(func(opts *Config) {
+		if fraction > 1 {
+			fraction = 1
+		}
+		opts.TTLJitter = fraction
+	})
+}
+
+// WithCopyOnRead returns a copy of the stored value from every read, enabled by default. Disabling it is an unsafe optimization:
+// returned slices share memory with the storage and modifying them corrupts stored values
+func WithCopyOnRead(enabled bool) Option {
+	return optionFunc(func(opts *Config) {
+		opts.CopyOnRead = enabled
+	})
+}
+
+// WithCopyOnWrite stores a copy of every written value, enabled by default. Disabling it is an unsafe optimization:
+// the storage keeps slices passed by callers and modifying them later changes stored values
+func WithCopyOnWrite(enabled bool) Option {
+	return optionFunc(func(opts *Config) {
+		opts.CopyOnWrite = enabled
+	})
+}
+
+// WithStartupLoadFile restores the backup from the file when the storage is created, nothing is loaded if the file does not exist
+func WithStartupLoadFile(path string) Option {
+	return optionFunc(func(opts *Config) {
+		opts.StartupLoadFile = path
+	})
+}
+
+// WithAutoBackup writes the full backup to the file every interval in background until Destroy, the file is replaced atomically
+// and can be loaded back by WithStartupLoadFile. Errors are passed to the hook set by WithBackupErrorHook
+func WithAutoBackup(path string, interval time.Duration) Option {
+	return optionFunc(func(opts *Config) {
+		opts.AutoBackupPath = path
+		opts.BackupInterval = interval
+	})
+}
+
+// WithBackupErrorHook sets the function receiving errors of periodic backups, they are ignored by default
+func WithBackupErrorHook(hook func(err error)) Option {
+	return optionFunc(func(opts *Config) {
+		opts.OnBackupError = hook
+	})
+}
+
+// WithMaxKeyLength rejects writes of keys longer than n bytes with ErrKeyTooLong, reads of such keys miss, zero means unlimited
+func WithMaxKeyLength(n int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.MaxKeyLength = n
+	})
+}
+
+// WithMaxValueSize rejects writes of values larger than n bytes before compression with ErrValueTooLarge, zero means unlimited.
+// The size is checked before the storage is modified
+func WithMaxValueSize(n int) Option {
+	return optionFunc(func(opts *Config) {
+		opts.MaxValueSize = n
+	})
+}
+
+// WithUniqueNameRegistry reserves the name of the storage until Destroy, creating another storage with the same name
+// and this option fails with ErrInvalidName. Storages created without the option are not checked
+func WithUniqueNameRegistry() Option {
+	return optionFunc(func(opts *Config) {
+		opts.UniqueName = true
+	})
+}
+
+// WithReadOnly opens the storage in read-only mode, it can be changed later by SetReadOnly
+func WithReadOnly(readOnly bool) Option {
+	return optionFunc(func(opts *Config) {
+		opts.ReadOnly = readOnly
+	})
+}
 
@@ -0,0 +1,116 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDefaultTTL(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock), WithDefaultTTL(60))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	var ttl int
+	if _, err := s.GetRaw([]byte("k"), &ttl, nil, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if ttl != 60 {
+		t.Fatalf("ttl %d, expected the default 60", ttl)
+	}
+
+	clock.Advance(61 * time.Second)
+	if ok, _ := s.Exists([]byte("k")); ok {
+		t.Fatalf("key outlived the default ttl")
+	}
+}
+
+func TestValidator(t *testing.T) {
+
+	errEmpty := errors.New("empty value")
+	s := newTestStorage(t, WithValidator(func(key, value []byte) error {
+		if len(value) == 0 {
+			return errEmpty
+		}
+		return nil
+	}))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("accepted write returned %v", err)
+	}
+	if err := s.SetRaw([]byte("k"), nil, 0); !errors.Is(err, errEmpty) {
+		t.Fatalf("rejected write returned %v", err)
+	}
+
+	value, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(value) != "v" {
+		t.Fatalf("rejected write changed the value to %q, %v", value, err)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock), WithTTLJitter(0.1))
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := s.SetRaw(key, []byte("v"), 100); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		ttl, ok, err := s.TTL(key)
+		if !ok || err != nil {
+			t.Fatalf("ttl %v, %v", ok, err)
+		}
+		if ttl < 90*time.Second || ttl > 110*time.Second {
+			t.Fatalf("ttl %v is out of the jitter window", ttl)
+		}
+		distinct[ttl] = true
+	}
+	if len(distinct) < 10 {
+		t.Fatalf("only %d distinct expirations of 100 keys", len(distinct))
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxKeyLength(8))
+
+	if err := s.SetRaw([]byte("12345678"), []byte("v"), 0); err != nil {
+		t.Fatalf("key of the maximum length: %v", err)
+	}
+	if err := s.SetRaw([]byte("123456789"), []byte("v"), 0); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("key above the maximum length returned %v", err)
+	}
+	if ok, _ := s.Exists([]byte("123456789")); ok {
+		t.Fatalf("rejected key is stored")
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxValueSize(16))
+
+	if err := s.SetRaw([]byte("under"), make([]byte, 15), 0); err != nil {
+		t.Fatalf("value just under the limit: %v", err)
+	}
+	if err := s.SetRaw([]byte("exact"), make([]byte, 16), 0); err != nil {
+		t.Fatalf("value of the limit: %v", err)
+	}
+	if err := s.SetRaw([]byte("over"), make([]byte, 17), 0); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("value just over the limit returned %v", err)
+	}
+	if ok, _ := s.Exists([]byte("over")); ok {
+		t.Fatalf("rejected value is stored")
+	}
+}
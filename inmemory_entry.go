@@ -0,0 +1,53 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"encoding/gob"
+	"time"
+)
+
+func init() {
+	gob.Register(&entry{})
+}
+
+// entry is the object stored in the cache for every key, fields are exported for gob.
+// Version increases monotonically on every write of the key and never goes back while the key exists.
+type entry struct {
+	lastAccess int64 // unix nanoseconds by the storage clock of the last get or set, not encoded by gob, keep first for atomic alignment
+	Value      []byte
+	Version    int64
+	Modified   uint64            // logical modification number used by incremental backups
+	Expiration int64             // unix nanoseconds by the storage clock, zero means no expiration
+	Compressed bool              // Value is compressed by the storage compressor
+	Meta       map[string]string // optional tags, never modified after the entry is stored
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.Expiration > 0 && now.UnixNano() >= e.Expiration
+}
+
+// ttl returns remaining time before expiration or NeverExpires
+func (e *entry) ttl(now time.Time) time.Duration {
+	if e.Expiration <= 0 {
+		return NeverExpires
+	}
+	if left := time.Duration(e.Expiration - now.UnixNano()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// asEntry converts the cached object to entry, plain []byte objects are supported for caches filled outside of this package
+func asEntry(obj interface{}) (*entry, bool) {
+	switch v := obj.(type) {
+	case *entry:
+		return v, v != nil
+	case []byte:
+		return &entry{Value: v}, true
+	default:
+		return nil, false
+	}
+}
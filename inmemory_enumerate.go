@@ -0,0 +1,539 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"context"
+	"go.arpabet.com/storage"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnumerateRaw visits entries with the prefix in the order of keys, lexicographic unless WithKeyComparator is set, starting from seek, batchSize bounds how many entries are collected
+// before they are passed to the callback, with a value <= 0 every entry is passed as soon as it is read. With onlyKeys the Value of entries is left nil.
+// With batchSize <= 0 the callback sees a consistent point-in-time view taken when enumeration starts, concurrent writes are not visible in it.
+// Otherwise entries are captured batch by batch, so every batch is consistent but writes between them can be visible.
+// Entries expired by the storage clock are skipped even if the janitor has not removed them yet.
+// Version and Ttl of entries are the same as GetRaw reports, so entries can be replicated with their versions and remaining lifetime
+func (t *inmemoryStorage) EnumerateRaw(prefix, seek []byte, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("EnumerateRaw", prefix, time.Now(), &err)
+	}
+	return t.enumerateRaw(context.Background(), prefix, seek, batchSize, onlyKeys, cb)
+}
+
+// EnumerateRawContext is EnumerateRaw that checks the context between batches and returns its error if it is done
+func (t *inmemoryStorage) EnumerateRawContext(ctx context.Context, prefix, seek []byte, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("EnumerateRawContext", prefix, time.Now(), &err)
+	}
+	return t.enumerateRaw(ctx, prefix, seek, batchSize, onlyKeys, cb)
+}
+
+func (t *inmemoryStorage) enumerateRaw(ctx context.Context, prefix, seek []byte, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) error {
+
+	prefixStr := t.rawKey(prefix)
+	from := t.fromKey(seek)
+
+	if batchSize <= 0 {
+		list := t.matchEntries(prefixStr, from)
+		t.sortEntries(list, false)
+		return t.visitEntries(ctx, t.conf.Clock.Now(), list, batchSize, onlyKeys, cb)
+	}
+
+	stopped := false
+	visit := func(entry *storage.RawEntry) bool {
+		stopped = !cb(entry)
+		return !stopped
+	}
+
+	next := t.keyChunks(prefixStr, batchSize, from)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys := next()
+		if len(keys) == 0 {
+			return nil
+		}
+		list := t.captureEntries(keys)
+		if err := t.visitEntries(ctx, t.conf.Clock.Now(), list, batchSize, onlyKeys, visit); err != nil || stopped {
+			return err
+		}
+	}
+}
+
+// EnumerateRawLimit is EnumerateRaw that stops after limit callbacks returned true and returns the key to seek from to resume,
+// the returned key is nil when there are no more entries or the callback returned false
+func (t *inmemoryStorage) EnumerateRawLimit(prefix, seek []byte, limit int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) (next []byte, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("EnumerateRawLimit", prefix, time.Now(), &err)
+	}
+
+	list := t.matchEntries(t.rawKey(prefix), t.fromKey(seek))
+	t.sortEntries(list, false)
+
+	now := t.conf.Clock.Now()
+	visited := 0
+	for _, ke := range list {
+
+		if ke.e.expired(now) {
+			continue
+		}
+		if limit > 0 && visited == limit {
+			return []byte(t.userKey(ke.key)), nil
+		}
+
+		re := &storage.RawEntry{
+			Key:     []byte(t.userKey(ke.key)),
+			Ttl:     ttlSeconds(ke.e.ttl(now)),
+			Version: ke.e.Version,
+		}
+		if !onlyKeys {
+			value, err := t.decode(ke.e)
+			if err != nil {
+				return nil, err
+			}
+			re.Value = value
+		}
+		if !cb(re) {
+			return nil, nil
+		}
+		visited++
+	}
+
+	return nil, nil
+}
+
+// EnumerateRawReverse visits entries with the prefix in descending order of keys, not empty seek is the inclusive upper bound
+func (t *inmemoryStorage) EnumerateRawReverse(prefix, seek []byte, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("EnumerateRawReverse", prefix, time.Now(), &err)
+	}
+
+	prefixStr := t.rawKey(prefix)
+	seekStr := t.rawKey(seek)
+
+	list := t.matchEntries(prefixStr, func(key string) bool {
+		return len(seek) == 0 || t.compareKeys(key, seekStr) <= 0
+	})
+	t.sortEntries(list, true)
+
+	return t.visitEntries(context.Background(), t.conf.Clock.Now(), list, batchSize, onlyKeys, cb)
+}
+
+// RangeScan visits entries with keys from inclusive start to exclusive end in the order of keys, empty end means no upper bound
+func (t *inmemoryStorage) RangeScan(start, end []byte, cb func(entry *storage.RawEntry) bool) error {
+
+	endStr := t.rawKey(end)
+	from := t.fromKey(start)
+
+	list := t.matchEntries(t.ns, func(key string) bool {
+		return from(key) && (len(end) == 0 || t.compareKeys(key, endStr) < 0)
+	})
+	t.sortEntries(list, false)
+
+	return t.visitEntries(context.Background(), t.conf.Clock.Now(), list, 0, false, cb)
+}
+
+// ScanPattern visits entries with keys matching the glob pattern in the order of keys,
+// '*' matches any sequence of bytes including separators and '?' matches a single byte
+func (t *inmemoryStorage) ScanPattern(pattern string, cb func(entry *storage.RawEntry) bool) error {
+
+	list := t.matchEntries(t.ns+literalPrefix(pattern), func(key string) bool {
+		return globMatch(pattern, t.userKey(key))
+	})
+	t.sortEntries(list, false)
+
+	return t.visitEntries(context.Background(), t.conf.Clock.Now(), list, 0, false, cb)
+}
+
+// EnumerateRegex visits entries with keys matching the regular expression in the order of keys
+func (t *inmemoryStorage) EnumerateRegex(re *regexp.Regexp, onlyKeys bool, cb func(entry *storage.RawEntry) bool) error {
+
+	list := t.matchEntries(t.ns, func(key string) bool {
+		return re.MatchString(t.userKey(key))
+	})
+	t.sortEntries(list, false)
+
+	return t.visitEntries(context.Background(), t.conf.Clock.Now(), list, 0, onlyKeys, cb)
+}
+
+// globMatch matches the string against the pattern with '*' and '?' wildcards
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			// let the last star consume one more byte
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// compareKeys orders cache keys by the configured comparator of storage keys, byte-lexicographic by default
+func (t *inmemoryStorage) compareKeys(a, b string) int {
+	if t.conf.KeyComparator == nil {
+		return strings.Compare(a, b)
+	}
+	return t.conf.KeyComparator([]byte(t.userKey(a)), []byte(t.userKey(b)))
+}
+
+// fromKey returns the filter of keys at or after the seek key by compareKeys, empty seek accepts all keys
+func (t *inmemoryStorage) fromKey(seek []byte) func(key string) bool {
+	if len(seek) == 0 {
+		return func(string) bool {
+			return true
+		}
+	}
+	seekStr := t.rawKey(seek)
+	return func(key string) bool {
+		return t.compareKeys(key, seekStr) >= 0
+	}
+}
+
+// sortEntries orders captured entries by compareKeys, descending with reverse
+func (t *inmemoryStorage) sortEntries(list keyEntries, reverse bool) {
+	if t.conf.KeyComparator == nil {
+		if reverse {
+			sort.Sort(sort.Reverse(list))
+		} else {
+			sort.Sort(list)
+		}
+		return
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		c := t.compareKeys(list[i].key, list[j].key)
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+// keyEntry is the entry of the key captured by matchEntries
+type keyEntry struct {
+	key string
+	e   *entry
+}
+
+// keyEntries sorts captured entries by key
+type keyEntries []keyEntry
+
+func (t keyEntries) Len() int           { return len(t) }
+func (t keyEntries) Less(i, j int) bool { return t[i].key < t[j].key }
+func (t keyEntries) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// matchEntries captures entries of keys with the prefix accepted by the filter at a single point in time walking the key index instead of copying the whole cache.
+// Writes wait while the view is taken, entries are immutable so later writes do not affect captured ones. The wait grows with the number of walked keys,
+// so large stores are better enumerated by positive batch sizes that take the view only per batch.
+// Entries put into the cache directly bypassing the storage are not visible here
+func (t *inmemoryStorage) matchEntries(prefix string, filter func(key string) bool) keyEntries {
+	var list keyEntries
+	start := time.Now()
+	scanned := 0
+	t.view.Lock()
+	defer func() {
+		t.view.Unlock()
+		t.stats.scan(scanned, time.Since(start))
+	}()
+	t.lru.forEachPrefix(prefix, func(key string) bool {
+		scanned++
+		if filter(key) {
+			if obj, ok := t.shards.of(key).Get(key); ok {
+				if e, ok := asEntry(obj); ok {
+					list = append(list, keyEntry{key: key, e: e})
+				}
+			}
+		}
+		return true
+	})
+	return list
+}
+
+// keyChunks returns the function passing keys with the prefix accepted by the filter in the order of keys by up to n at a time,
+// it returns no keys when all of them are passed. The prefix index is walked from the last passed key, without it or with WithKeyComparator
+// the keys are collected and sorted at the first call, entries are captured by captureEntries only for the keys of a chunk
+func (t *inmemoryStorage) keyChunks(prefix string, n int, filter func(key string) bool) func() []string {
+	var after string
+	resume, collected := false, false
+	var sorted []string
+	return func() []string {
+		if !collected {
+			var keys []string
+			from := prefix
+			if resume {
+				from = after
+			}
+			indexed := t.conf.KeyComparator == nil && t.lru.forEachSortedFrom(prefix, from, func(key string) bool {
+				if (!resume || key > after) && filter(key) {
+					keys = append(keys, key)
+				}
+				return len(keys) < n
+			})
+			if indexed {
+				if len(keys) > 0 {
+					after, resume = keys[len(keys)-1], true
+				}
+				return keys
+			}
+			t.lru.forEachPrefix(prefix, func(key string) bool {
+				if filter(key) {
+					sorted = append(sorted, key)
+				}
+				return true
+			})
+			sort.Slice(sorted, func(i, j int) bool {
+				return t.compareKeys(sorted[i], sorted[j]) < 0
+			})
+			collected = true
+		}
+		chunk := sorted
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		sorted = sorted[len(chunk):]
+		return chunk
+	}
+}
+
+// captureEntries captures entries of the keys at a single point in time, keys removed by then are skipped
+func (t *inmemoryStorage) captureEntries(keys []string) keyEntries {
+	list := make(keyEntries, 0, len(keys))
+	start := time.Now()
+	t.view.Lock()
+	defer func() {
+		t.view.Unlock()
+		t.stats.scan(len(keys), time.Since(start))
+	}()
+	for _, key := range keys {
+		if obj, ok := t.shards.of(key).Get(key); ok {
+			if e, ok := asEntry(obj); ok {
+				list = append(list, keyEntry{key: key, e: e})
+			}
+		}
+	}
+	return list
+}
+
+// visitEntries passes captured entries not expired at the time now in the given order to the callback by batches and checks the context between them
+func (t *inmemoryStorage) visitEntries(ctx context.Context, now time.Time, list keyEntries, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var batch []*storage.RawEntry
+	if batchSize > 0 {
+		batch = make([]*storage.RawEntry, 0, batchSize)
+	}
+
+	for _, ke := range list {
+
+		e := ke.e
+		if e.expired(now) {
+			continue
+		}
+		if batchSize <= 0 {
+			// there are no batches to check the context between
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		re := &storage.RawEntry{
+			Key:     []byte(t.userKey(ke.key)),
+			Ttl:     ttlSeconds(e.ttl(now)),
+			Version: e.Version,
+		}
+		if !onlyKeys {
+			value, err := t.decode(e)
+			if err != nil {
+				return err
+			}
+			re.Value = value
+		}
+		if batchSize <= 0 {
+			// unlimited batch, values are decoded only for entries the callback asks for
+			if !cb(re) {
+				return nil
+			}
+			continue
+		}
+		batch = append(batch, re)
+		if len(batch) == batchSize {
+			if !flushBatch(batch, cb) {
+				return nil
+			}
+			batch = batch[:0]
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	flushBatch(batch, cb)
+	return nil
+}
+
+// ExpiringWithin passes keys in the order of keys with remaining ttl to the callback for entries expiring in at most d,
+// entries without expiration are skipped
+func (t *inmemoryStorage) ExpiringWithin(d time.Duration, cb func(key []byte, remaining time.Duration) bool) error {
+
+	list := t.matchEntries(t.ns, func(string) bool {
+		return true
+	})
+	t.sortEntries(list, false)
+
+	now := t.conf.Clock.Now()
+	for _, ke := range list {
+		if ke.e.Expiration <= 0 {
+			continue
+		}
+		if left := ke.e.ttl(now); left > 0 && left <= d {
+			if !cb([]byte(t.userKey(ke.key)), left) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// FirstKey returns the smallest not expired key with the prefix by the key order and a flag if there is any
+func (t *inmemoryStorage) FirstKey(prefix []byte) ([]byte, bool, error) {
+	return t.boundKey(prefix, false, func(a, b string) bool {
+		return t.compareKeys(a, b) < 0
+	})
+}
+
+// LastKey returns the largest not expired key with the prefix by the key order and a flag if there is any
+func (t *inmemoryStorage) LastKey(prefix []byte) ([]byte, bool, error) {
+	return t.boundKey(prefix, true, func(a, b string) bool {
+		return t.compareKeys(a, b) > 0
+	})
+}
+
+// boundKey returns the key preceding all others by the order without sorting the keys, with the prefix index and the default order
+// it walks the index from the first or the last key stopping at the first live one
+func (t *inmemoryStorage) boundKey(prefix []byte, last bool, before func(a, b string) bool) ([]byte, bool, error) {
+
+	prefixStr := t.rawKey(prefix)
+
+	if t.conf.KeyComparator == nil {
+		found := false
+		var bound string
+		indexed := t.lru.forEachSorted(prefixStr, last, func(k string) bool {
+			if _, ok := t.lookup(k); ok {
+				bound, found = k, true
+				return false
+			}
+			return true
+		})
+		if indexed {
+			if !found {
+				return nil, false, nil
+			}
+			return []byte(t.userKey(bound)), true, nil
+		}
+	}
+
+	list := t.matchEntries(prefixStr, func(string) bool {
+		return true
+	})
+
+	now := t.conf.Clock.Now()
+	found := false
+	var bound string
+	for _, ke := range list {
+		if ke.e.expired(now) {
+			continue
+		}
+		if !found || before(ke.key, bound) {
+			bound, found = ke.key, true
+		}
+	}
+
+	if !found {
+		return nil, false, nil
+	}
+	return []byte(t.userKey(bound)), true, nil
+}
+
+// FetchKeysRaw returns keys with the prefix in the order of keys, at most batchSize of them when it is > 0
+func (t *inmemoryStorage) FetchKeysRaw(prefix []byte, batchSize int) (keys [][]byte, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("FetchKeysRaw", prefix, time.Now(), &err)
+	}
+	return t.fetchKeysRaw(context.Background(), prefix, batchSize)
+}
+
+// FetchKeysRawContext is FetchKeysRaw that returns the context error if it is done before keys are collected
+func (t *inmemoryStorage) FetchKeysRawContext(ctx context.Context, prefix []byte, batchSize int) (keys [][]byte, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("FetchKeysRawContext", prefix, time.Now(), &err)
+	}
+	return t.fetchKeysRaw(ctx, prefix, batchSize)
+}
+
+func (t *inmemoryStorage) fetchKeysRaw(ctx context.Context, prefix []byte, batchSize int) ([][]byte, error) {
+
+	prefixStr := t.rawKey(prefix)
+
+	matched := t.matchEntries(prefixStr, func(key string) bool {
+		return true
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := t.conf.Clock.Now()
+	var keys []string
+	for _, ke := range matched {
+		if !ke.e.expired(now) {
+			keys = append(keys, ke.key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return t.compareKeys(keys[i], keys[j]) < 0
+	})
+
+	if batchSize > 0 && len(keys) > batchSize {
+		keys = keys[:batchSize]
+	}
+
+	list := make([][]byte, len(keys))
+	for i, key := range keys {
+		list[i] = []byte(t.userKey(key))
+	}
+	return list, nil
+}
+
+// flushBatch passes entries to the callback and returns false if the callback requested to stop
+func flushBatch(batch []*storage.RawEntry, cb func(entry *storage.RawEntry) bool) bool {
+	for _, re := range batch {
+		if !cb(re) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,666 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"fmt"
+	"go.arpabet.com/storage"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCompressor stores values of a repeated byte as the byte and the length and counts decompressions,
+// so tests see how many values were materialized
+type countingCompressor struct {
+	decompressed int64
+}
+
+func (c *countingCompressor) Compress(value []byte) ([]byte, error) {
+	if len(value) > 255 || !bytes.Equal(value, bytes.Repeat(value[:1], len(value))) {
+		return value, nil
+	}
+	return []byte{value[0], byte(len(value))}, nil
+}
+
+func (c *countingCompressor) Decompress(data []byte) ([]byte, error) {
+	atomic.AddInt64(&c.decompressed, 1)
+	return bytes.Repeat(data[:1], int(data[1])), nil
+}
+
+func fillKeys(t testing.TB, s *inmemoryStorage, n int) {
+	for i := 0; i < n; i++ {
+		if err := s.SetRaw([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{byte('a' + i%26)}, 16), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+}
+
+func TestEnumerateBatchSize(t *testing.T) {
+
+	for _, batchSize := range []int{-1, 0, 1, 3, 100} {
+
+		c := &countingCompressor{}
+		s := newTestStorage(t, WithCompression(c))
+		fillKeys(t, s, 10)
+
+		atomic.StoreInt64(&c.decompressed, 0)
+		err := s.EnumerateRaw(nil, nil, batchSize, false, func(*storage.RawEntry) bool {
+			return false
+		})
+		if err != nil {
+			t.Fatalf("enumerate: %v", err)
+		}
+
+		limit := int64(batchSize)
+		if limit <= 0 {
+			limit = 1
+		}
+		if limit > 10 {
+			limit = 10
+		}
+		if n := atomic.LoadInt64(&c.decompressed); n != limit {
+			t.Fatalf("batch size %d materialized %d values, expected %d", batchSize, n, limit)
+		}
+
+		visited := 0
+		err = s.EnumerateRaw(nil, nil, batchSize, false, func(*storage.RawEntry) bool {
+			visited++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("enumerate: %v", err)
+		}
+		if visited != 10 {
+			t.Fatalf("batch size %d visited %d entries", batchSize, visited)
+		}
+	}
+}
+
+func TestEnumerateBatchesResume(t *testing.T) {
+
+	for _, options := range [][]Option{nil, {WithPrefixIndex()}} {
+
+		s := newTestStorage(t, options...)
+		fillKeys(t, s, 10)
+
+		keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+			return s.EnumerateRaw([]byte("key"), []byte("key004"), 2, true, cb)
+		})
+		if !reflect.DeepEqual(keys, []string{"key004", "key005", "key006", "key007", "key008", "key009"}) {
+			t.Fatalf("enumerated %q", keys)
+		}
+
+		// batches are captured when they are reached, so a write made by the first one is seen by the last one
+		var last []byte
+		err := s.EnumerateRaw(nil, nil, 3, false, func(entry *storage.RawEntry) bool {
+			switch string(entry.Key) {
+			case "key000":
+				if err := s.SetRaw([]byte("key009"), []byte("changed"), 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			case "key009":
+				last = entry.Value
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("enumerate: %v", err)
+		}
+		if string(last) != "changed" {
+			t.Fatalf("last batch saw %q", last)
+		}
+		s.Destroy()
+	}
+}
+
+func TestEnumerateOnlyKeys(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 5)
+
+	visited := 0
+	err := s.EnumerateRaw(nil, nil, 0, true, func(entry *storage.RawEntry) bool {
+		visited++
+		if entry.Key == nil {
+			t.Fatalf("entry without key")
+		}
+		if entry.Value != nil {
+			t.Fatalf("value %q of key %q with onlyKeys", entry.Value, entry.Key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("enumerate: %v", err)
+	}
+	if visited != 5 {
+		t.Fatalf("visited %d entries", visited)
+	}
+}
+
+func TestEnumerateSeekInHalves(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 20)
+
+	seen := make(map[string]int)
+	var last []byte
+	err := s.EnumerateRaw(nil, nil, 0, true, func(entry *storage.RawEntry) bool {
+		seen[string(entry.Key)]++
+		last = entry.Key
+		return len(seen) < 10
+	})
+	if err != nil {
+		t.Fatalf("enumerate first half: %v", err)
+	}
+
+	// seek is inclusive, so the last key of the first half comes again
+	err = s.EnumerateRaw(nil, last, 0, true, func(entry *storage.RawEntry) bool {
+		if bytes.Equal(entry.Key, last) {
+			return true
+		}
+		seen[string(entry.Key)]++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("enumerate second half: %v", err)
+	}
+
+	if len(seen) != 20 {
+		t.Fatalf("visited %d keys, expected 20", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("key %q visited %d times", key, n)
+		}
+	}
+}
+
+func TestFetchKeysStableOrder(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 50)
+
+	first, err := s.FetchKeysRaw(nil, 0)
+	if err != nil {
+		t.Fatalf("fetch keys: %v", err)
+	}
+	if len(first) != 50 {
+		t.Fatalf("fetched %d keys", len(first))
+	}
+	for i := 1; i < len(first); i++ {
+		if bytes.Compare(first[i-1], first[i]) >= 0 {
+			t.Fatalf("keys %q and %q are out of order", first[i-1], first[i])
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		again, err := s.FetchKeysRaw(nil, 0)
+		if err != nil {
+			t.Fatalf("fetch keys: %v", err)
+		}
+		if !reflect.DeepEqual(first, again) {
+			t.Fatalf("order changed between calls")
+		}
+	}
+
+	batch, err := s.FetchKeysRaw(nil, 7)
+	if err != nil {
+		t.Fatalf("fetch keys: %v", err)
+	}
+	if !reflect.DeepEqual(batch, first[:7]) {
+		t.Fatalf("batch %q is not the head of all keys", batch)
+	}
+}
+
+// visitedKeys runs the enumeration and returns keys passed to its callback
+func visitedKeys(t *testing.T, enumerate func(cb func(entry *storage.RawEntry) bool) error) []string {
+	var keys []string
+	err := enumerate(func(entry *storage.RawEntry) bool {
+		keys = append(keys, string(entry.Key))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("enumerate: %v", err)
+	}
+	return keys
+}
+
+func TestEnumerateReverse(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"a1", "a2", "a3", "a4", "b1"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRawReverse([]byte("a"), nil, 0, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"a4", "a3", "a2", "a1"}) {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+
+	keys = visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRawReverse([]byte("a"), []byte("a3"), 0, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"a3", "a2", "a1"}) {
+		t.Fatalf("seek is not the ceiling, keys %q", keys)
+	}
+}
+
+func TestRangeScan(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	cases := []struct {
+		start, end string
+		keys       []string
+	}{
+		{"b", "d", []string{"b", "c"}},
+		{"", "c", []string{"a", "b"}},
+		{"d", "", []string{"d", "e"}},
+		{"bb", "cc", []string{"c"}},
+		{"c", "c", nil},
+		{"d", "b", nil},
+		{"x", "z", nil},
+	}
+	for _, c := range cases {
+		keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+			return s.RangeScan([]byte(c.start), []byte(c.end), cb)
+		})
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("range [%q, %q) visited %q, expected %q", c.start, c.end, keys, c.keys)
+		}
+	}
+}
+
+// BenchmarkEnumerateLargeStore reports the longest write made during enumeration, writes wait for the whole view
+// taken by the unlimited batch and only for a single batch otherwise
+func BenchmarkEnumerateLargeStore(b *testing.B) {
+
+	for _, batchSize := range []int{0, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+
+			s := newTestStorage(b)
+			fillKeys(b, s, 100000)
+
+			stop := make(chan struct{})
+			done := make(chan time.Duration)
+			go func() {
+				var longest time.Duration
+				for {
+					select {
+					case <-stop:
+						done <- longest
+						return
+					default:
+					}
+					start := time.Now()
+					if err := s.SetRaw([]byte("written"), []byte("v"), 0); err != nil {
+						b.Errorf("set: %v", err)
+					}
+					if d := time.Since(start); d > longest {
+						longest = d
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := s.EnumerateRaw(nil, nil, batchSize, false, func(*storage.RawEntry) bool {
+					return true
+				})
+				if err != nil {
+					b.Fatalf("enumerate: %v", err)
+				}
+			}
+			b.StopTimer()
+
+			close(stop)
+			b.ReportMetric(float64(<-done), "max-write-ns")
+		})
+	}
+}
+
+func TestScanPattern(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"user:1:name", "user:2:name", "user:2:mail", "group:1:name", "user:10:name"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	cases := []struct {
+		pattern string
+		keys    []string
+	}{
+		{"user:*:name", []string{"user:10:name", "user:1:name", "user:2:name"}},
+		{"user:?:name", []string{"user:1:name", "user:2:name"}},
+		{"*:1:*", []string{"group:1:name", "user:1:name"}},
+		{"*mail", []string{"user:2:mail"}},
+		{"group:*", []string{"group:1:name"}},
+		{"user:2:name", []string{"user:2:name"}},
+		{"*absent*", nil},
+	}
+	for _, c := range cases {
+		keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+			return s.ScanPattern(c.pattern, cb)
+		})
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("pattern %q matched %q, expected %q", c.pattern, keys, c.keys)
+		}
+	}
+}
+
+func TestEnumerateRegex(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"order-100", "order-20", "invoice-100", "xorder-1"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	cases := []struct {
+		expr string
+		keys []string
+	}{
+		{`^order-\d+$`, []string{"order-100", "order-20"}},
+		{`order`, []string{"order-100", "order-20", "xorder-1"}},
+		{`-100$`, []string{"invoice-100", "order-100"}},
+	}
+	for _, c := range cases {
+		re := regexp.MustCompile(c.expr)
+		keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+			return s.EnumerateRegex(re, true, cb)
+		})
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("expression %q matched %q, expected %q", c.expr, keys, c.keys)
+		}
+	}
+}
+
+func TestEnumerateSnapshotUnderWrites(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 100)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := s.SetRaw([]byte(fmt.Sprintf("new%06d", i)), []byte("v"), 0); err != nil {
+				t.Errorf("set: %v", err)
+				return
+			}
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		var seen []int
+		old := 0
+		err := s.EnumerateRaw(nil, nil, 0, true, func(entry *storage.RawEntry) bool {
+			key := string(entry.Key)
+			if strings.HasPrefix(key, "new") {
+				n, err := strconv.Atoi(key[3:])
+				if err != nil {
+					t.Fatalf("unexpected key %q", key)
+				}
+				seen = append(seen, n)
+			} else {
+				old++
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("enumerate: %v", err)
+		}
+		if old != 100 {
+			t.Fatalf("visited %d of 100 existing keys", old)
+		}
+		// new keys are written in order, a point-in-time view holds all of them up to some key and none after it
+		for i, n := range seen {
+			if n != i {
+				t.Fatalf("round %d saw key new%06d at position %d, the view is partial", round, n, i)
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestEnumerateLimitPages(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 95)
+
+	var all []string
+	var seek []byte
+	pages := 0
+	for {
+		page := 0
+		next, err := s.EnumerateRawLimit(nil, seek, 10, true, func(entry *storage.RawEntry) bool {
+			all = append(all, string(entry.Key))
+			page++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("enumerate: %v", err)
+		}
+		if page > 10 {
+			t.Fatalf("page of %d entries", page)
+		}
+		pages++
+		if next == nil {
+			break
+		}
+		seek = next
+	}
+
+	if pages != 10 {
+		t.Fatalf("%d pages, expected 10", pages)
+	}
+	expected := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRaw(nil, nil, 0, true, cb)
+	})
+	if !reflect.DeepEqual(all, expected) {
+		t.Fatalf("pages assembled %d keys, expected %d", len(all), len(expected))
+	}
+}
+
+func TestEnumerateSkipsExpired(t *testing.T) {
+
+	clock := newManualClock()
+	// the janitor never runs during the test
+	s := newTestStorage(t, WithClock(clock), WithCleanupInterval(0))
+
+	if err := s.SetRaw([]byte("short"), []byte("v"), 1); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRaw(nil, nil, 0, false, cb)
+	})
+	if len(keys) != 0 {
+		t.Fatalf("enumeration returned expired keys %q", keys)
+	}
+	fetched, err := s.FetchKeysRaw(nil, 0)
+	if err != nil || len(fetched) != 0 {
+		t.Fatalf("fetch returned expired keys %q, %v", fetched, err)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("the expired entry is removed before the janitor runs, len %d", n)
+	}
+}
+
+func TestFirstAndLastKey(t *testing.T) {
+
+	for _, options := range [][]Option{nil, {WithPrefixIndex()}} {
+
+		clock := newManualClock()
+		s := newTestStorage(t, append(options, WithClock(clock))...)
+		for _, key := range []string{"a", "b1", "b2", "b3", "c"} {
+			if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+		}
+		// expired keys at both ends of the prefix are skipped
+		for _, key := range []string{"b0", "b4"} {
+			if err := s.SetRaw([]byte(key), []byte("v"), 1); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+		}
+		clock.Advance(2 * time.Second)
+
+		cases := []struct {
+			prefix, first, last string
+			found               bool
+		}{
+			{"", "a", "c", true},
+			{"b", "b1", "b3", true},
+			{"c", "c", "c", true},
+			{"x", "", "", false},
+		}
+		for _, c := range cases {
+			first, ok, err := s.FirstKey([]byte(c.prefix))
+			if err != nil || ok != c.found || string(first) != c.first {
+				t.Fatalf("first key of %q is %q, %v, %v", c.prefix, first, ok, err)
+			}
+			last, ok, err := s.LastKey([]byte(c.prefix))
+			if err != nil || ok != c.found || string(last) != c.last {
+				t.Fatalf("last key of %q is %q, %v, %v", c.prefix, last, ok, err)
+			}
+		}
+	}
+}
+
+func TestKeyComparator(t *testing.T) {
+
+	// keys are compared by length first, so numeric keys come in numeric order
+	s := newTestStorage(t, WithKeyComparator(func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}))
+	for _, key := range []string{"10", "9", "100", "1"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRaw(nil, nil, 0, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"1", "9", "10", "100"}) {
+		t.Fatalf("enumerated %q", keys)
+	}
+
+	keys = visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRaw(nil, nil, 1, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"1", "9", "10", "100"}) {
+		t.Fatalf("enumerated by batches %q", keys)
+	}
+
+	keys = visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return s.EnumerateRaw(nil, []byte("9"), 0, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"9", "10", "100"}) {
+		t.Fatalf("enumerated from seek %q", keys)
+	}
+
+	if last, _, _ := s.LastKey(nil); string(last) != "100" {
+		t.Fatalf("last key %q", last)
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	ttls := map[string]int{"never": 0, "far": 3600, "soon1": 5, "soon2": 30, "edge": 60}
+	for key, ttl := range ttls {
+		if err := s.SetRaw([]byte(key), []byte("v"), ttl); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	remaining := make(map[string]time.Duration)
+	err := s.ExpiringWithin(time.Minute, func(key []byte, left time.Duration) bool {
+		remaining[string(key)] = left
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expiring within: %v", err)
+	}
+
+	expected := map[string]time.Duration{"soon1": 5 * time.Second, "soon2": 30 * time.Second, "edge": time.Minute}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Fatalf("expiring %v, expected %v", remaining, expected)
+	}
+}
+
+func TestEnumerateVersionAndTTL(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	writes := []struct {
+		key string
+		ttl int
+	}{
+		{"a", 0}, {"b", 30}, {"b", 60}, {"c", 10}, {"c", 20}, {"c", 90},
+	}
+	for _, w := range writes {
+		if err := s.SetRaw([]byte(w.key), []byte("v"), w.ttl); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	clock.Advance(5 * time.Second)
+
+	expected := map[string]storage.RawEntry{
+		"a": {Ttl: NeverExpiresTTL, Version: 1},
+		"b": {Ttl: 55, Version: 2},
+		"c": {Ttl: 85, Version: 3},
+	}
+	visited := 0
+	err := s.EnumerateRaw(nil, nil, 0, false, func(entry *storage.RawEntry) bool {
+		visited++
+		want := expected[string(entry.Key)]
+		if entry.Ttl != want.Ttl || entry.Version != want.Version {
+			t.Fatalf("key %q has ttl %d and version %d, expected %d and %d", entry.Key, entry.Ttl, entry.Version, want.Ttl, want.Version)
+		}
+		return true
+	})
+	if err != nil || visited != 3 {
+		t.Fatalf("enumerated %d entries, %v", visited, err)
+	}
+}
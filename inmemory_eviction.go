@@ -0,0 +1,120 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"github.com/patrickmn/go-cache"
+	"sync"
+)
+
+// EvictionReason tells why an entry left the storage
+type EvictionReason int
+
+const (
+	ReasonExpired EvictionReason = iota
+	ReasonDeleted
+	ReasonOverwritten
+	ReasonCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case ReasonExpired:
+		return "expired"
+	case ReasonDeleted:
+		return "deleted"
+	case ReasonOverwritten:
+		return "overwritten"
+	case ReasonCapacity:
+		return "capacity"
+	default:
+		return "unknown"
+	}
+}
+
+// Policy selects entries evicted when MaxEntries or MaxMemoryBytes is exceeded
+type Policy int
+
+const (
+	PolicyLRU  Policy = iota // least recently read or written entry is evicted first, the default
+	PolicyLFU                // least frequently read or written entry is evicted first, the oldest one among equally used
+	PolicyFIFO               // the earliest inserted entry is evicted first, overwrites and reads do not change the order
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyLRU:
+		return "lru"
+	case PolicyLFU:
+		return "lfu"
+	case PolicyFIFO:
+		return "fifo"
+	default:
+		return "unknown"
+	}
+}
+
+// pendingDeletes tracks explicit deletes of all storages, so the eviction callback of the cache hands removed objects back to them
+// even when another storage sharing the cache registered the callback, keys missing here expired in the cache itself
+var pendingDeletes evictionReasons
+
+type evictionReasons struct {
+	stripes [lockStripes]reasonStripe
+}
+
+type reasonStripe struct {
+	mu      sync.Mutex
+	pending map[pendingKey]*pendingDelete
+}
+
+type pendingKey struct {
+	c *cache.Cache
+	k string
+}
+
+// pendingDelete receives the object removed from the cache by the delete
+type pendingDelete struct {
+	obj     interface{}
+	removed bool
+}
+
+func (t *evictionReasons) of(k string) *reasonStripe {
+	return &t.stripes[fnv32a(k)%lockStripes]
+}
+
+func (t *evictionReasons) mark(c *cache.Cache, k string) *pendingDelete {
+	s := t.of(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[pendingKey]*pendingDelete)
+	}
+	p := &pendingDelete{}
+	s.pending[pendingKey{c, k}] = p
+	return p
+}
+
+// take passes the removed object to the delete of the key and returns false if there is none
+func (t *evictionReasons) take(c *cache.Cache, k string, obj interface{}) bool {
+	s := t.of(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[pendingKey{c, k}]
+	if ok {
+		p.obj, p.removed = obj, true
+	}
+	return ok
+}
+
+// unmark finishes the delete and returns the object it removed, a concurrent delete of the same key could remove it instead
+func (t *evictionReasons) unmark(c *cache.Cache, k string, p *pendingDelete) (interface{}, bool) {
+	s := t.of(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pk := (pendingKey{c, k}); s.pending[pk] == p {
+		delete(s.pending, pk)
+	}
+	return p.obj, p.removed
+}
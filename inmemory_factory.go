@@ -5,24 +5,82 @@
 package inmemorystorage
 
 import (
+	"fmt"
 	"github.com/patrickmn/go-cache"
+	"strings"
 	"time"
 )
 
+// OpenDatabase creates the cache and loads the startup file into it if it is configured,
+// it panics if options are invalid or the file can not be loaded, NewE returns the error instead
 func OpenDatabase(options ...Option) *cache.Cache {
+	conf := newConfig(options...)
+	if err := conf.validate(); err != nil {
+		panic(err)
+	}
+	c := openCache(conf)
+	if conf.StartupLoadFile != "" {
+		if err := newStorage("", shards{c}, conf).loadFile(conf.StartupLoadFile); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+func newConfig(options ...Option) *Config {
 
 	conf := &Config{
 		DefaultExpiration: cache.NoExpiration,
 		CleanupInterval:  time.Hour,
+		Clock:            systemClock{},
+		Shards:           1,
+		Serializer:       GobSerializer{},
+		Compressor:       NoCompressor{},
+		CopyOnRead:       true,
+		CopyOnWrite:      true,
 	}
 
 	for _, opt := range options {
 		opt.apply(conf)
 	}
 
-	return cache.New(conf.DefaultExpiration, conf.CleanupInterval)
+	return conf
 }
 
+// validate rejects negative limits, missing dependencies and conflicting options with ErrInvalidOption
+func (conf *Config) validate() error {
+	switch {
+	case conf.MaxEntries < 0:
+		return fmt.Errorf("%w: negative MaxEntries %d", ErrInvalidOption, conf.MaxEntries)
+	case conf.MaxMemoryBytes < 0:
+		return fmt.Errorf("%w: negative MaxMemoryBytes %d", ErrInvalidOption, conf.MaxMemoryBytes)
+	case conf.Shards < 0:
+		return fmt.Errorf("%w: negative Shards %d", ErrInvalidOption, conf.Shards)
+	case conf.MaxKeyLength < 0:
+		return fmt.Errorf("%w: negative MaxKeyLength %d", ErrInvalidOption, conf.MaxKeyLength)
+	case conf.MaxValueSize < 0:
+		return fmt.Errorf("%w: negative MaxValueSize %d", ErrInvalidOption, conf.MaxValueSize)
+	case conf.InitialCapacity < 0:
+		return fmt.Errorf("%w: negative InitialCapacity %d", ErrInvalidOption, conf.InitialCapacity)
+	case conf.TTLJitter < 0:
+		return fmt.Errorf("%w: negative TTLJitter %v", ErrInvalidOption, conf.TTLJitter)
+	case conf.EvictionPolicy < PolicyLRU || conf.EvictionPolicy > PolicyFIFO:
+		return fmt.Errorf("%w: unknown EvictionPolicy %d", ErrInvalidOption, conf.EvictionPolicy)
+	case conf.Clock == nil:
+		return fmt.Errorf("%w: nil Clock", ErrInvalidOption)
+	case conf.Serializer == nil:
+		return fmt.Errorf("%w: nil Serializer", ErrInvalidOption)
+	case strings.Contains(conf.Namespace, "/"):
+		return fmt.Errorf("%w: slash in Namespace %q", ErrInvalidOption, conf.Namespace)
+	case conf.AutoBackupPath != "" && conf.BackupInterval <= 0:
+		return fmt.Errorf("%w: AutoBackupPath without positive BackupInterval", ErrInvalidOption)
+	}
+	return nil
+}
 
-
-
+func openCache(conf *Config) *cache.Cache {
+	if conf.InitialCapacity > 0 {
+		return cache.NewFrom(conf.DefaultExpiration, conf.CleanupInterval, make(map[string]cache.Item, conf.InitialCapacity))
+	}
+	return cache.New(conf.DefaultExpiration, conf.CleanupInterval)
+}
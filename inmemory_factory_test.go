@@ -0,0 +1,65 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func BenchmarkLoadWithInitialCapacity(b *testing.B) {
+
+	const n = 1000000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%07d", i))
+	}
+	value := []byte("value")
+
+	for _, capacity := range []int{0, n} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// every storage is destroyed right away, so it is not kept until the end of the benchmark
+				s := New(b.Name(), WithInitialCapacity(capacity))
+				for _, key := range keys {
+					if err := s.SetRaw(key, value, 0); err != nil {
+						b.Fatalf("set: %v", err)
+					}
+				}
+				s.Destroy()
+			}
+		})
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+
+	cases := map[string][]Option{
+		"negative max entries":         {WithMaxEntries(-1)},
+		"negative shards":              {WithShards(-2)},
+		"unknown policy":               {WithEvictionPolicy(Policy(42))},
+		"nil clock":                    {WithClock(nil)},
+		"auto backup without interval": {WithAutoBackup("backup", 0)},
+		"negative value size":          {WithMaxValueSize(-1)},
+	}
+	for name, options := range cases {
+		s, err := NewE("test", options...)
+		if !errors.Is(err, ErrInvalidOption) {
+			t.Fatalf("%s: error %v", name, err)
+		}
+		if s != nil {
+			t.Fatalf("%s: storage is created", name)
+		}
+	}
+
+	s, err := NewE("test", WithMaxEntries(10), WithCleanupInterval(time.Minute))
+	if err != nil {
+		t.Fatalf("valid options: %v", err)
+	}
+	s.Destroy()
+}
@@ -0,0 +1,53 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sync"
+)
+
+// freezer blocks modifications of the cache between Freeze and Thaw
+type freezer struct {
+	state  sync.Mutex // serializes Freeze and Thaw
+	frozen bool
+	writes sync.RWMutex // shared by modifications, held exclusively while frozen
+}
+
+// enter waits until the storage is not frozen and must be followed by leave
+func (f *freezer) enter() {
+	f.writes.RLock()
+}
+
+func (f *freezer) leave() {
+	f.writes.RUnlock()
+}
+
+// Freeze waits for modifications in progress and blocks new ones until Thaw, reads and enumerations proceed.
+// The goroutine calling Freeze must not write before Thaw, repeated calls have no effect
+func (t *inmemoryStorage) Freeze() {
+	t.freeze.state.Lock()
+	defer t.freeze.state.Unlock()
+	if !t.freeze.frozen {
+		t.freeze.writes.Lock()
+		t.freeze.frozen = true
+	}
+}
+
+// Thaw resumes writes blocked by Freeze, it has no effect on a storage that is not frozen
+func (t *inmemoryStorage) Thaw() {
+	t.freeze.state.Lock()
+	defer t.freeze.state.Unlock()
+	if t.freeze.frozen {
+		t.freeze.frozen = false
+		t.freeze.writes.Unlock()
+	}
+}
+
+// Frozen returns true between Freeze and Thaw
+func (t *inmemoryStorage) Frozen() bool {
+	t.freeze.state.Lock()
+	defer t.freeze.state.Unlock()
+	return t.freeze.frozen
+}
@@ -0,0 +1,96 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"github.com/patrickmn/go-cache"
+	"testing"
+	"time"
+)
+
+func TestFreezeBlocksWriters(t *testing.T) {
+
+	s := newTestStorage(t)
+	s.Freeze()
+	if !s.Frozen() {
+		t.Fatalf("storage is not frozen")
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- s.SetRaw([]byte("k"), []byte("v"), 0)
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("write finished during freeze: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// reads are not blocked
+	if _, err := s.GetRaw([]byte("other"), nil, nil, false); err != nil {
+		t.Fatalf("get during freeze: %v", err)
+	}
+
+	s.Thaw()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("write after thaw: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write is still blocked after thaw")
+	}
+	if ok, _ := s.Exists([]byte("k")); !ok {
+		t.Fatalf("blocked write is lost")
+	}
+}
+
+func TestFreezeBlocksRestoreAndHealthCheck(t *testing.T) {
+
+	legacy := cache.New(cache.NoExpiration, 0)
+	legacy.Set("k", []byte("legacy"), cache.NoExpiration)
+	var dump bytes.Buffer
+	if err := legacy.Save(&dump); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s := newTestStorage(t)
+	writes := map[string]func() error{
+		"legacy restore": func() error {
+			return s.Restore(&dump)
+		},
+		"health check": s.HealthCheck,
+	}
+
+	for name, write := range writes {
+		s.Freeze()
+		done := make(chan error, 1)
+		go func() {
+			done <- write()
+		}()
+
+		select {
+		case err := <-done:
+			t.Fatalf("%s finished during freeze: %v", name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		s.Thaw()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("%s after thaw: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s is still blocked after thaw", name)
+		}
+	}
+
+	if ok, _ := s.Exists([]byte("k")); !ok {
+		t.Fatalf("restored key is missing")
+	}
+}
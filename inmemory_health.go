@@ -0,0 +1,59 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"strconv"
+	"sync/atomic"
+)
+
+// healthKey is the prefix of reserved keys written by HealthCheck, a user key with the same name is never replaced
+const healthKey = "\x00inmemorystorage/health/"
+
+var healthSeq uint64
+
+// healthProbe is the object written by HealthCheck, it is not a storage entry, so reads, enumerations and backups skip it
+type healthProbe struct {
+	token string
+}
+
+// HealthCheck writes, reads back and deletes a reserved key in every shard of the cache and reports the first failed step.
+// User data is not modified, eviction callbacks and watchers are not notified. The probe is a write, so it waits for Thaw while the storage is frozen
+func (t *inmemoryStorage) HealthCheck() error {
+	for i, c := range t.shards {
+		t.freeze.enter()
+		err := checkShard(c)
+		t.freeze.leave()
+		if err != nil {
+			return fmt.Errorf("inmemorystorage: health check of %q failed in shard %d: %v", t.name, i, err)
+		}
+	}
+	return nil
+}
+
+func checkShard(c *cache.Cache) error {
+
+	token := strconv.FormatUint(atomic.AddUint64(&healthSeq, 1), 10)
+	k := healthKey + token
+
+	if err := c.Add(k, healthProbe{token: token}, cache.NoExpiration); err != nil {
+		return err
+	}
+
+	obj, found := c.Get(k)
+	c.Delete(k)
+	if !found {
+		return fmt.Errorf("written key %q is missing", k)
+	}
+	if probe, ok := obj.(healthProbe); !ok || probe.token != token {
+		return fmt.Errorf("written key %q holds %v", k, obj)
+	}
+	if _, found := c.Get(k); found {
+		return fmt.Errorf("deleted key %q is present", k)
+	}
+	return nil
+}
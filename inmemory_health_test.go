@@ -0,0 +1,26 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+
+	for _, shards := range []int{1, 4} {
+		s := newTestStorage(t, WithShards(shards))
+		if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+
+		if err := s.HealthCheck(); err != nil {
+			t.Fatalf("health check of %d shards: %v", shards, err)
+		}
+		if n := s.Len(); n != 1 {
+			t.Fatalf("health check left %d entries", n)
+		}
+	}
+}
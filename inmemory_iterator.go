@@ -0,0 +1,78 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"go.arpabet.com/storage"
+	"time"
+)
+
+// Iterator pulls entries one by one, Entry is valid after Next returned true
+type Iterator interface {
+	Next() bool
+	Entry() *storage.RawEntry
+	// Err returns the error that stopped the iteration, like a failed decompression of the value
+	Err() error
+	Close()
+}
+
+// NewIterator iterates entries with the prefix in the order of keys starting from seek over the point-in-time view like EnumerateRaw
+func (t *inmemoryStorage) NewIterator(prefix, seek []byte, onlyKeys bool) Iterator {
+
+	list := t.matchEntries(t.rawKey(prefix), t.fromKey(seek))
+	t.sortEntries(list, false)
+
+	return &iterator{t: t, list: list, now: t.conf.Clock.Now(), onlyKeys: onlyKeys}
+}
+
+type iterator struct {
+	t        *inmemoryStorage
+	list     keyEntries
+	now      time.Time
+	onlyKeys bool
+	cur      *storage.RawEntry
+	err      error
+}
+
+func (it *iterator) Next() bool {
+	it.cur = nil
+	for it.err == nil && len(it.list) > 0 {
+		ke := it.list[0]
+		it.list = it.list[1:]
+		if ke.e.expired(it.now) {
+			continue
+		}
+		re := &storage.RawEntry{
+			Key:     []byte(it.t.userKey(ke.key)),
+			Ttl:     ttlSeconds(ke.e.ttl(it.now)),
+			Version: ke.e.Version,
+		}
+		if !it.onlyKeys {
+			value, err := it.t.decode(ke.e)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			re.Value = value
+		}
+		it.cur = re
+		return true
+	}
+	return false
+}
+
+func (it *iterator) Entry() *storage.RawEntry {
+	return it.cur
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
+
+// Close releases captured entries, Next returns false after it
+func (it *iterator) Close() {
+	it.list = nil
+	it.cur = nil
+}
@@ -0,0 +1,64 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIteratorExhaustion(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 10)
+
+	it := s.NewIterator([]byte("key"), []byte("key005"), false)
+	defer it.Close()
+
+	i := 5
+	for it.Next() {
+		entry := it.Entry()
+		if key := fmt.Sprintf("key%03d", i); string(entry.Key) != key {
+			t.Fatalf("entry %q, expected %q", entry.Key, key)
+		}
+		if len(entry.Value) == 0 {
+			t.Fatalf("entry %q without value", entry.Key)
+		}
+		i++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if i != 10 {
+		t.Fatalf("iterated up to %d", i)
+	}
+	if it.Next() {
+		t.Fatalf("exhausted iterator advanced")
+	}
+}
+
+func TestIteratorCloseEarly(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 10)
+
+	it := s.NewIterator(nil, nil, true)
+	if !it.Next() || string(it.Entry().Key) != "key000" {
+		t.Fatalf("first entry is not key000")
+	}
+	if it.Entry().Value != nil {
+		t.Fatalf("value with onlyKeys")
+	}
+	it.Close()
+
+	if it.Next() {
+		t.Fatalf("closed iterator advanced")
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("close reported %v", err)
+	}
+	// repeated close is safe
+	it.Close()
+}
@@ -0,0 +1,40 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sync"
+	"time"
+)
+
+// janitor periodically runs the cleanup function in the background until stopped
+type janitor struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func startJanitor(interval time.Duration, cleanup func()) *janitor {
+	j := &janitor{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cleanup()
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+// stop terminates the background goroutine, safe to call many times
+func (j *janitor) stop() {
+	j.once.Do(func() {
+		close(j.done)
+	})
+}
@@ -0,0 +1,75 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDestroyStopsJanitor(t *testing.T) {
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 200; i++ {
+		s := newTestStorage(t, WithCleanupInterval(time.Minute))
+		if err := s.Destroy(); err != nil {
+			t.Fatalf("destroy: %v", err)
+		}
+		// repeated calls are safe
+		if err := s.Destroy(); err != nil {
+			t.Fatalf("destroy again: %v", err)
+		}
+	}
+
+	// stopped goroutines exit asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines grew from %d to %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNonPositiveCleanupIntervalDisablesJanitor(t *testing.T) {
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+
+		clock := newManualClock()
+		before := runtime.NumGoroutine()
+		storages := make([]*inmemoryStorage, 50)
+		for i := range storages {
+			storages[i] = newTestStorage(t, WithCleanupInterval(interval), WithClock(clock))
+			if storages[i].janitor != nil {
+				t.Fatalf("interval %v started the janitor", interval)
+			}
+		}
+		if n := runtime.NumGoroutine(); n > before+5 {
+			t.Fatalf("interval %v grew goroutines from %d to %d", interval, before, n)
+		}
+
+		s := storages[0]
+		if err := s.SetRaw([]byte("k"), []byte("v"), 1); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		clock.Advance(time.Minute)
+		time.Sleep(50 * time.Millisecond)
+		if n := s.Len(); n != 1 {
+			t.Fatalf("interval %v left %d expired entries before the sweep", interval, n)
+		}
+		if removed := s.DeleteExpiredCollect(); len(removed) != 1 || string(removed[0]) != "k" {
+			t.Fatalf("sweep removed %q", removed)
+		}
+		if n := s.Len(); n != 0 {
+			t.Fatalf("%d entries after the sweep", n)
+		}
+
+		for _, s := range storages {
+			s.Destroy()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sort"
+	"sync"
+)
+
+const lockStripes = 256
+
+// keyLocks is a set of mutexes of individual keys, mutexes exist only while they are used.
+// Keys are spread over stripes by hash to reduce contention on the bookkeeping
+type keyLocks struct {
+	stripes [lockStripes]lockStripe
+}
+
+type lockStripe struct {
+	mu   sync.Mutex
+	held map[string]*keyLock
+}
+
+// keyLock is the mutex of the key with the number of goroutines holding or waiting for it
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// keyMutex locks a single key, different keys never block each other
+type keyMutex struct {
+	stripe *lockStripe
+	key    string
+	lock   *keyLock
+}
+
+// of returns the mutex guarding the key
+func (t *keyLocks) of(k string) *keyMutex {
+	return &keyMutex{stripe: &t.stripes[fnv32a(k)%lockStripes], key: k}
+}
+
+func (m *keyMutex) Lock() {
+	s := m.stripe
+	s.mu.Lock()
+	l, ok := s.held[m.key]
+	if !ok {
+		if s.held == nil {
+			s.held = make(map[string]*keyLock)
+		}
+		l = &keyLock{}
+		s.held[m.key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+	l.Lock()
+	m.lock = l
+}
+
+// TryLock locks the key only if no goroutine holds or waits for it and reports if it did
+func (m *keyMutex) TryLock() bool {
+	s := m.stripe
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, busy := s.held[m.key]; busy {
+		return false
+	}
+	if s.held == nil {
+		s.held = make(map[string]*keyLock)
+	}
+	l := &keyLock{refs: 1}
+	l.Lock()
+	s.held[m.key] = l
+	m.lock = l
+	return true
+}
+
+func (m *keyMutex) Unlock() {
+	s := m.stripe
+	l := m.lock
+	m.lock = nil
+	l.Unlock()
+	s.mu.Lock()
+	if l.refs--; l.refs == 0 {
+		delete(s.held, m.key)
+	}
+	s.mu.Unlock()
+}
+
+// lockAll locks mutexes of all keys in the order of keys to avoid deadlocks and returns the function unlocking them
+func (t *keyLocks) lockAll(keys ...string) func() {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	mutexes := make([]*keyMutex, len(sorted))
+	for i, k := range sorted {
+		mutexes[i] = t.of(k)
+		mutexes[i].Lock()
+	}
+	return func() {
+		for j := len(mutexes) - 1; j >= 0; j-- {
+			mutexes[j].Unlock()
+		}
+	}
+}
+
+func fnv32a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
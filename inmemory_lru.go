@@ -0,0 +1,259 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+type lruItem struct {
+	key  string
+	size int64
+	hits int // number of accesses, counted only by PolicyLFU
+}
+
+// lruList keeps keys ordered by the eviction policy together with their approximate sizes,
+// the key to evict first is at the back
+type lruList struct {
+	mu     sync.Mutex
+	order  *list.List
+	index  map[string]*list.Element
+	bytes  int64
+	sorted *sortedKeys // nil unless the prefix index is enabled
+	policy Policy
+	heads  map[int]*list.Element // PolicyLFU keeps keys ordered by hits, this is the frontmost key with the number of hits
+}
+
+func newLRUList(capacity int, prefixIndex bool, policy Policy) *lruList {
+	t := &lruList{
+		order:  list.New(),
+		index:  make(map[string]*list.Element, capacity),
+		policy: policy,
+	}
+	if prefixIndex {
+		t.sorted = newSortedKeys(capacity)
+	}
+	if policy == PolicyLFU {
+		t.heads = make(map[int]*list.Element)
+	}
+	return t
+}
+
+// touch records the access of the key
+func (t *lruList) touch(k string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.index[k]; ok {
+		t.access(el)
+	}
+}
+
+// update records the new size of the key and the access of it
+func (t *lruList) update(k string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.index[k]; ok {
+		item := el.Value.(*lruItem)
+		t.bytes += size - item.size
+		item.size = size
+		t.access(el)
+	} else {
+		t.index[k] = t.insert(&lruItem{key: k, size: size})
+		t.bytes += size
+		if t.sorted != nil {
+			t.sorted.insert(k)
+		}
+	}
+}
+
+// insert puts the new item to the place of the policy, must be called under the lock
+func (t *lruList) insert(item *lruItem) *list.Element {
+	if t.policy != PolicyLFU {
+		return t.order.PushFront(item)
+	}
+	item.hits = 1
+	var el *list.Element
+	if head, ok := t.heads[1]; ok {
+		el = t.order.InsertBefore(item, head)
+	} else {
+		// all other keys are used more often
+		el = t.order.PushBack(item)
+	}
+	t.heads[1] = el
+	return el
+}
+
+// access moves the element according to the policy, must be called under the lock
+func (t *lruList) access(el *list.Element) {
+	switch t.policy {
+	case PolicyFIFO:
+	case PolicyLFU:
+		item := el.Value.(*lruItem)
+		head := t.heads[item.hits]
+		if head == el {
+			t.leaveBucket(el)
+		} else {
+			// become the last one of the next bucket right before the current one
+			t.order.MoveBefore(el, head)
+		}
+		item.hits++
+		if _, ok := t.heads[item.hits]; !ok {
+			t.heads[item.hits] = el
+		}
+	default:
+		t.order.MoveToFront(el)
+	}
+}
+
+// leaveBucket passes the head of the bucket of hits to the next element if the element is the head, must be called under the lock
+func (t *lruList) leaveBucket(el *list.Element) {
+	if t.heads == nil {
+		return
+	}
+	hits := el.Value.(*lruItem).hits
+	if t.heads[hits] != el {
+		return
+	}
+	if next := el.Next(); next != nil && next.Value.(*lruItem).hits == hits {
+		t.heads[hits] = next
+	} else {
+		delete(t.heads, hits)
+	}
+}
+
+func (t *lruList) remove(k string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.index[k]; ok {
+		t.leaveBucket(el)
+		t.order.Remove(el)
+		delete(t.index, k)
+		t.bytes -= el.Value.(*lruItem).size
+		if t.sorted != nil {
+			t.sorted.remove(k)
+		}
+	}
+}
+
+// popOldest removes and returns the key to evict first by the policy while there are more than maxEntries keys
+// or they take more than maxBytes, zero limits are ignored. Keys rejected by claim are skipped, so the just written key is never evicted,
+// it could be the first one to evict by PolicyLFU starting with the lowest number of hits or by PolicyFIFO keeping the place of overwritten keys
+func (t *lruList) popOldest(maxEntries int, maxBytes int64, claim func(k string) bool) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if (maxEntries <= 0 || t.order.Len() <= maxEntries) && (maxBytes <= 0 || t.bytes <= maxBytes) {
+		return "", false
+	}
+	el := t.order.Back()
+	for el != nil && !claim(el.Value.(*lruItem).key) {
+		el = el.Prev()
+	}
+	if el == nil {
+		return "", false
+	}
+	t.leaveBucket(el)
+	t.order.Remove(el)
+	item := el.Value.(*lruItem)
+	delete(t.index, item.key)
+	t.bytes -= item.size
+	if t.sorted != nil {
+		t.sorted.remove(item.key)
+	}
+	return item.key, true
+}
+
+// forEach calls the callback for every tracked key under the lock until it returns false
+func (t *lruList) forEach(cb func(k string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		if !cb(el.Value.(*lruItem).key) {
+			return
+		}
+	}
+}
+
+// forEachPrefix calls the callback for tracked keys with the prefix under the lock until it returns false,
+// keys come in lexicographic order only with the prefix index
+func (t *lruList) forEachPrefix(prefix string, cb func(k string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sorted != nil {
+		t.sorted.forEachPrefix(prefix, cb)
+		return
+	}
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		if k := el.Value.(*lruItem).key; strings.HasPrefix(k, prefix) && !cb(k) {
+			return
+		}
+	}
+}
+
+// forEachSorted calls the callback for tracked keys with the prefix in lexicographic or reverse order under the lock until it returns false,
+// without the prefix index it returns false and does not call the callback
+func (t *lruList) forEachSorted(prefix string, reverse bool, cb func(k string) bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sorted == nil {
+		return false
+	}
+	if reverse {
+		t.sorted.forEachPrefixReverse(prefix, cb)
+	} else {
+		t.sorted.forEachPrefix(prefix, cb)
+	}
+	return true
+}
+
+// forEachSortedFrom calls the callback for tracked keys with the prefix at or after the key from in lexicographic order under the lock
+// until it returns false, without the prefix index it returns false and does not call the callback
+func (t *lruList) forEachSortedFrom(prefix, from string, cb func(k string) bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sorted == nil {
+		return false
+	}
+	t.sorted.forEachFrom(prefix, from, cb)
+	return true
+}
+
+// oldest returns up to n keys in the order of eviction by the policy
+func (t *lruList) oldest(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]string, 0, n)
+	for el := t.order.Back(); el != nil && len(keys) < n; el = el.Prev() {
+		keys = append(keys, el.Value.(*lruItem).key)
+	}
+	return keys
+}
+
+func (t *lruList) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.order.Len()
+}
+
+func (t *lruList) size() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes
+}
+
+func (t *lruList) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.order.Init()
+	t.index = make(map[string]*list.Element)
+	t.bytes = 0
+	if t.sorted != nil {
+		t.sorted = newSortedKeys(0)
+	}
+	if t.heads != nil {
+		t.heads = make(map[int]*list.Element)
+	}
+}
@@ -0,0 +1,102 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"testing"
+)
+
+func TestMaxEntriesEvictsLeastRecentlyUsed(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxEntries(3))
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.SetRaw([]byte(key), []byte(key), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	// reading a makes b the least recently used key
+	if _, err := s.GetRaw([]byte("a"), nil, nil, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := s.SetRaw([]byte("d"), []byte("d"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	if n := s.Len(); n != 3 {
+		t.Fatalf("len %d, expected 3", n)
+	}
+	for key, present := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if ok, _ := s.Exists([]byte(key)); ok != present {
+			t.Fatalf("key %q present %v, expected %v", key, ok, present)
+		}
+	}
+}
+
+func TestEvictionSkipsLockedKeys(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxEntries(2))
+
+	for _, key := range []string{"a", "b"} {
+		if err := s.SetRaw([]byte(key), []byte(key), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	// a concurrent write of a holds its lock, so b is evicted instead
+	mu := s.locks.of("a")
+	mu.Lock()
+	if err := s.SetRaw([]byte("c"), []byte("c"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	mu.Unlock()
+
+	for key, present := range map[string]bool{"a": true, "b": false, "c": true} {
+		if ok, _ := s.Exists([]byte(key)); ok != present {
+			t.Fatalf("key %q present %v, expected %v", key, ok, present)
+		}
+	}
+	for i := range s.locks.stripes {
+		if n := len(s.locks.stripes[i].held); n != 0 {
+			t.Fatalf("stripe %d keeps %d key locks", i, n)
+		}
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+
+	cases := []struct {
+		policy  Policy
+		evicted string
+	}{
+		{PolicyLRU, "c"},
+		{PolicyLFU, "b"},
+		{PolicyFIFO, "a"},
+	}
+	for _, c := range cases {
+
+		s := newTestStorage(t, WithMaxEntries(3), WithEvictionPolicy(c.policy))
+		for _, key := range []string{"a", "b", "c"} {
+			if err := s.SetRaw([]byte(key), []byte(key), 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+		}
+		// c is used most but least recently, b least often, a was inserted first
+		for _, key := range []string{"c", "c", "c", "a", "a", "b"} {
+			if _, err := s.GetRaw([]byte(key), nil, nil, true); err != nil {
+				t.Fatalf("get: %v", err)
+			}
+		}
+		if err := s.SetRaw([]byte("d"), []byte("d"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+
+		for _, key := range []string{"a", "b", "c", "d"} {
+			if ok, _ := s.Exists([]byte(key)); ok == (key == c.evicted) {
+				t.Fatalf("policy %v: key %q present %v, expected %q to be evicted", c.policy, key, ok, c.evicted)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"time"
+)
+
+// SetRawWithMeta is SetRaw attaching string tags to the entry, tags are replaced by every write and kept by Touch, Backup and Restore
+func (t *inmemoryStorage) SetRawWithMeta(key, value []byte, ttlSeconds int, meta map[string]string) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SetRawWithMeta", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	return t.putMeta(k, value, t.versionOf(k)+1, ttl, copyMeta(meta))
+}
+
+// GetMeta returns tags of the entry or nil if the key is absent or has no tags
+func (t *inmemoryStorage) GetMeta(key []byte) (map[string]string, error) {
+	if e, ok := t.lookup(t.rawKey(key)); ok {
+		return copyMeta(e.Meta), nil
+	}
+	return nil, nil
+}
+
+// DropWithTag removes entries having the tag with the value and returns their number
+func (t *inmemoryStorage) DropWithTag(key, value string) (int, error) {
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+
+	list := t.matchEntries(t.ns, func(string) bool {
+		return true
+	})
+
+	cnt := 0
+	for _, ke := range list {
+		if !hasTag(ke.e.Meta, key, value) {
+			continue
+		}
+		mu := t.locks.of(ke.key)
+		mu.Lock()
+		// the entry could be rewritten without the tag after the view was taken
+		if e, ok := t.lookup(ke.key); ok && hasTag(e.Meta, key, value) {
+			t.delete(ke.key, ReasonDeleted)
+			cnt++
+		}
+		mu.Unlock()
+	}
+	return cnt, nil
+}
+
+func hasTag(meta map[string]string, key, value string) bool {
+	v, ok := meta[key]
+	return ok && v == value
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for k, v := range meta {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,68 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDropWithTag(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	tagged := map[string]map[string]string{
+		"a": {"tenant": "acme", "type": "json"},
+		"b": {"tenant": "acme"},
+		"c": {"tenant": "other"},
+		"d": nil,
+	}
+	for key, meta := range tagged {
+		if err := s.SetRawWithMeta([]byte(key), []byte("v"), 0, meta); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	n, err := s.DropWithTag("tenant", "acme")
+	if err != nil {
+		t.Fatalf("drop with tag: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("dropped %d entries, expected 2", n)
+	}
+	for key, present := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if ok, _ := s.Exists([]byte(key)); ok != present {
+			t.Fatalf("key %q present %v, expected %v", key, ok, present)
+		}
+	}
+
+	meta, err := s.GetMeta([]byte("c"))
+	if err != nil || !reflect.DeepEqual(meta, map[string]string{"tenant": "other"}) {
+		t.Fatalf("tags %v, %v", meta, err)
+	}
+}
+
+func TestTagsSurviveBackup(t *testing.T) {
+
+	src := newTestStorage(t)
+	if err := src.SetRawWithMeta([]byte("k"), []byte("v"), 0, map[string]string{"tenant": "acme"}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := src.Backup(&buf, 0); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	dst := newTestStorage(t)
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	meta, err := dst.GetMeta([]byte("k"))
+	if err != nil || meta["tenant"] != "acme" {
+		t.Fatalf("restored tags %v, %v", meta, err)
+	}
+}
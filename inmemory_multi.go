@@ -0,0 +1,132 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"go.arpabet.com/storage"
+	"sync/atomic"
+	"time"
+)
+
+// concatKey builds the raw key in a fresh buffer, the prefix slice is never modified
+func concatKey(prefix, key []byte) string {
+	buf := make([]byte, len(prefix)+len(key))
+	copy(buf, prefix)
+	copy(buf[len(prefix):], key)
+	return string(buf)
+}
+
+// GetMulti fetches values of the keys under the prefix, absent keys are omitted from the result keyed by the keys without the prefix
+func (t *inmemoryStorage) GetMulti(prefix []byte, keys [][]byte) (map[string][]byte, error) {
+
+	result := make(map[string][]byte, len(keys))
+	limited := t.limited()
+
+	for _, key := range keys {
+		k := t.ns + concatKey(prefix, key)
+		if e, ok := t.lookup(k); ok {
+			t.stats.hit()
+			value, err := t.decode(e)
+			if err != nil {
+				return nil, err
+			}
+			result[string(key)] = value
+			atomic.StoreInt64(&e.lastAccess, t.conf.Clock.Now().UnixNano())
+			if limited {
+				t.lru.touch(k)
+			}
+		} else {
+			t.stats.miss()
+		}
+	}
+
+	return result, nil
+}
+
+// SetMulti writes the entries under the prefix with the shared ttl, stops on the first failed key and reports it
+func (t *inmemoryStorage) SetMulti(prefix []byte, entries map[string][]byte, ttlSeconds int) error {
+	for key, value := range entries {
+		if err := t.SetRaw([]byte(concatKey(prefix, []byte(key))), value, ttlSeconds); err != nil {
+			return fmt.Errorf("set key %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// RemoveMulti deletes the keys under the prefix, absent keys are ignored
+func (t *inmemoryStorage) RemoveMulti(prefix []byte, keys [][]byte) error {
+	for _, key := range keys {
+		if err := t.RemoveRaw([]byte(concatKey(prefix, key))); err != nil {
+			return fmt.Errorf("remove key %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// DoInMultiTransaction holds locks of all keys during the read-modify-write of their entries keyed by string keys, absent keys have nil values.
+// When the callback returns true entries of the keys left in the map are written, otherwise ErrCanceled is returned. The callback must not access the storage
+func (t *inmemoryStorage) DoInMultiTransaction(keys [][]byte, cb func(entries map[string]*storage.RawEntry) bool) (err error) {
+	if t.conf.MetricsHook != nil {
+		// there is no single key of the operation
+		defer t.observe("DoInMultiTransaction", nil, time.Now(), &err)
+	}
+
+	raw := make([]string, len(keys))
+	for i, key := range keys {
+		raw[i] = t.rawKey(key)
+	}
+
+	unlock := t.locks.lockAll(raw...)
+	defer unlock()
+
+	entries := make(map[string]*storage.RawEntry, len(keys))
+	for i, key := range keys {
+		re := &storage.RawEntry{
+			Key: key,
+			Ttl: storage.NoTTL,
+		}
+		if e, ok := t.lookup(raw[i]); ok {
+			value, err := t.decode(e)
+			if err != nil {
+				return err
+			}
+			re.Value = value
+			re.Version = e.Version
+		}
+		entries[string(key)] = re
+	}
+
+	if !cb(entries) {
+		return ErrCanceled
+	}
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	// prepare everything before the first write to keep the commit all or nothing
+	prepared := make(map[string]*entry, len(keys))
+	for i, key := range keys {
+		re, ok := entries[string(key)]
+		if !ok {
+			continue
+		}
+		e, err := t.prepare(raw[i], re.Value, t.versionOf(raw[i])+1, t.ttlOrDefault(re.Ttl), nil)
+		if err != nil {
+			return err
+		}
+		prepared[raw[i]] = e
+	}
+
+	for _, k := range raw {
+		if e, ok := prepared[k]; ok {
+			// a repeated key is written once
+			delete(prepared, k)
+			t.store(k, e)
+		}
+	}
+	return nil
+}
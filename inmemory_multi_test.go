@@ -0,0 +1,168 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.arpabet.com/storage"
+	"sync"
+	"testing"
+)
+
+func TestGetMulti(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"p:a", "p:c", "q:b"} {
+		if err := s.SetRaw([]byte(key), []byte("v"+key), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	values, err := s.GetMulti([]byte("p:"), [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+	if err != nil {
+		t.Fatalf("get multi: %v", err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("got %d values, expected 2: %q", len(values), values)
+	}
+	if string(values["a"]) != "vp:a" || string(values["c"]) != "vp:c" {
+		t.Fatalf("unexpected values %q", values)
+	}
+	if _, ok := values["b"]; ok {
+		t.Fatalf("key of another prefix is returned")
+	}
+}
+
+func TestSetMulti(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	entries := make(map[string][]byte, 100)
+	for i := 0; i < 100; i++ {
+		entries[fmt.Sprintf("key%d", i)] = []byte(fmt.Sprintf("value%d", i))
+	}
+	if err := s.SetMulti([]byte("p:"), entries, 0); err != nil {
+		t.Fatalf("set multi: %v", err)
+	}
+
+	for key, expected := range entries {
+		value, err := s.GetRaw([]byte("p:"+key), nil, nil, true)
+		if err != nil {
+			t.Fatalf("get %q: %v", key, err)
+		}
+		if string(value) != string(expected) {
+			t.Fatalf("key %q has value %q, expected %q", key, value, expected)
+		}
+	}
+	if n := s.Len(); n != 100 {
+		t.Fatalf("len %d, expected 100", n)
+	}
+}
+
+func TestRemoveMulti(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"p:a", "p:b", "p:c", "q:a"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	if err := s.RemoveMulti([]byte("p:"), [][]byte{[]byte("a"), []byte("c"), []byte("absent")}); err != nil {
+		t.Fatalf("remove multi: %v", err)
+	}
+
+	for key, present := range map[string]bool{"p:a": false, "p:b": true, "p:c": false, "q:a": true} {
+		if ok, _ := s.Exists([]byte(key)); ok != present {
+			t.Fatalf("key %q present %v, expected %v", key, ok, present)
+		}
+	}
+}
+
+func balanceOf(entry *storage.RawEntry) int64 {
+	if len(entry.Value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(entry.Value))
+}
+
+func setBalance(entry *storage.RawEntry, balance int64) {
+	entry.Value = make([]byte, 8)
+	binary.BigEndian.PutUint64(entry.Value, uint64(balance))
+}
+
+func TestMultiTransactionTransfers(t *testing.T) {
+
+	s := newTestStorage(t)
+	keys := [][]byte{[]byte("alice"), []byte("bob")}
+
+	err := s.DoInMultiTransaction(keys, func(entries map[string]*storage.RawEntry) bool {
+		setBalance(entries["alice"], 1000)
+		setBalance(entries["bob"], 1000)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	const goroutines, transfers = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// half of goroutines lock keys in the reverse order
+			order := [][]byte{keys[i%2], keys[1-i%2]}
+			for j := 0; j < transfers; j++ {
+				err := s.DoInMultiTransaction(order, func(entries map[string]*storage.RawEntry) bool {
+					from, to := entries[string(order[0])], entries[string(order[1])]
+					if sum := balanceOf(from) + balanceOf(to); sum != 2000 {
+						t.Errorf("sum %d inside the transaction", sum)
+					}
+					amount := int64(j % 7)
+					setBalance(from, balanceOf(from)-amount)
+					setBalance(to, balanceOf(to)+amount)
+					return true
+				})
+				if err != nil {
+					t.Errorf("transfer: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	values, err := s.GetMulti(nil, keys)
+	if err != nil {
+		t.Fatalf("get multi: %v", err)
+	}
+	sum := int64(binary.BigEndian.Uint64(values["alice"])) + int64(binary.BigEndian.Uint64(values["bob"]))
+	if sum != 2000 {
+		t.Fatalf("sum %d after transfers, expected 2000", sum)
+	}
+}
+
+func TestMultiTransactionAllOrNothing(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxMemoryBytes(400))
+
+	err := s.DoInMultiTransaction([][]byte{[]byte("a"), []byte("b")}, func(entries map[string]*storage.RawEntry) bool {
+		entries["a"].Value = []byte("small")
+		entries["b"].Value = make([]byte, 1000)
+		return true
+	})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if _, found, err := s.GetRawFound([]byte("a")); err != nil || found {
+		t.Fatalf("a is written by the failed commit, found %v, err %v", found, err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("%d entries after the failed commit", n)
+	}
+}
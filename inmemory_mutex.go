@@ -0,0 +1,78 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Lock acquires the lock stored as the key holding a random token, the lock is released by Unlock with the token
+// or expires after ttl if the holder never releases it, ttl <= 0 means the lock never expires.
+// The key is an ordinary entry, so it is visible to reads and enumerations and is released by Remove
+func (t *inmemoryStorage) Lock(key []byte, ttl time.Duration) (token string, acquired bool, err error) {
+
+	if err := t.writable(); err != nil {
+		return "", false, err
+	}
+
+	token, err = newLockToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := t.lookup(k); ok {
+		return "", false, nil
+	}
+
+	if err := t.put(k, []byte(token), t.versionOf(k)+1, ttl); err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// Unlock releases the lock only if it is held with the token and returns true if it was released
+func (t *inmemoryStorage) Unlock(key []byte, token string) (bool, error) {
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := t.lookup(k)
+	if !ok {
+		return false, nil
+	}
+	value, err := t.decode(e)
+	if err != nil {
+		return false, err
+	}
+	if string(value) != token {
+		return false, nil
+	}
+
+	t.delete(k, ReasonDeleted)
+	return true, nil
+}
+
+func newLockToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,81 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockContention(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	const goroutines = 16
+	var acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := s.Lock([]byte("lock"), time.Minute)
+			if err != nil {
+				t.Errorf("lock: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&acquired); n != 1 {
+		t.Fatalf("lock acquired %d times", n)
+	}
+}
+
+func TestLockExpiry(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if _, ok, err := s.Lock([]byte("lock"), 10*time.Second); !ok || err != nil {
+		t.Fatalf("lock %v, %v", ok, err)
+	}
+	if _, ok, _ := s.Lock([]byte("lock"), 10*time.Second); ok {
+		t.Fatalf("held lock acquired again")
+	}
+
+	clock.Advance(11 * time.Second)
+	if _, ok, err := s.Lock([]byte("lock"), 10*time.Second); !ok || err != nil {
+		t.Fatalf("expired lock is not acquired, %v", err)
+	}
+}
+
+func TestUnlockWithWrongToken(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	token, ok, err := s.Lock([]byte("lock"), time.Minute)
+	if !ok || err != nil {
+		t.Fatalf("lock %v, %v", ok, err)
+	}
+
+	if released, err := s.Unlock([]byte("lock"), "wrong"); released || err != nil {
+		t.Fatalf("unlock with a wrong token %v, %v", released, err)
+	}
+	if _, ok, _ := s.Lock([]byte("lock"), time.Minute); ok {
+		t.Fatalf("lock is released by a wrong token")
+	}
+
+	if released, err := s.Unlock([]byte("lock"), token); !released || err != nil {
+		t.Fatalf("unlock with the token %v, %v", released, err)
+	}
+	if _, ok, _ := s.Lock([]byte("lock"), time.Minute); !ok {
+		t.Fatalf("released lock is not acquired")
+	}
+}
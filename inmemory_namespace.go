@@ -0,0 +1,35 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"strings"
+)
+
+// namespacePrefix returns the prefix of cache keys for the namespace, empty namespace means no prefix
+func namespacePrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return namespace + "/"
+}
+
+// rawKey returns the cache key of the storage key
+func (t *inmemoryStorage) rawKey(key []byte) string {
+	if t.ns == "" {
+		return string(key)
+	}
+	return t.ns + string(key)
+}
+
+// userKey returns the storage key of the cache key in the namespace
+func (t *inmemoryStorage) userKey(k string) string {
+	return k[len(t.ns):]
+}
+
+// owns returns true if the cache key belongs to the namespace of the storage
+func (t *inmemoryStorage) owns(k string) bool {
+	return strings.HasPrefix(k, t.ns)
+}
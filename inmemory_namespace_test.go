@@ -0,0 +1,62 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"go.arpabet.com/storage"
+	"reflect"
+	"testing"
+)
+
+func TestNamespacesShareCache(t *testing.T) {
+
+	c := OpenDatabase()
+	a := FromCache("a", c, WithNamespace("a")).(*inmemoryStorage)
+	b := FromCache("b", c, WithNamespace("b")).(*inmemoryStorage)
+	defer a.Destroy()
+	defer b.Destroy()
+
+	if err := a.SetRaw([]byte("k"), []byte("from a"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := b.SetRaw([]byte("k"), []byte("from b"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := b.SetRaw([]byte("only b"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	value, err := a.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(value) != "from a" {
+		t.Fatalf("a reads %q, %v", value, err)
+	}
+	if ok, _ := a.Exists([]byte("only b")); ok {
+		t.Fatalf("key of b is visible in a")
+	}
+
+	keys := visitedKeys(t, func(cb func(entry *storage.RawEntry) bool) error {
+		return b.EnumerateRaw(nil, nil, 0, true, cb)
+	})
+	if !reflect.DeepEqual(keys, []string{"k", "only b"}) {
+		t.Fatalf("b enumerates %q", keys)
+	}
+	if a.Len() != 1 || b.Len() != 2 || c.ItemCount() != 3 {
+		t.Fatalf("len of a %d, b %d, cache %d", a.Len(), b.Len(), c.ItemCount())
+	}
+
+	if err := a.DropAll(); err != nil {
+		t.Fatalf("drop all: %v", err)
+	}
+	if b.Len() != 2 {
+		t.Fatalf("DropAll of a removed keys of b")
+	}
+}
+
+func TestNamespaceWithSlash(t *testing.T) {
+	if _, err := NewE("test", WithNamespace("a/b")); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("namespace with slash returned %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"go.arpabet.com/storage"
+	"io"
+)
+
+// DumpPairs writes not expired entries sorted by key as records of big endian uint32 key length, key, uint32 value length and value
+func (t *inmemoryStorage) DumpPairs(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+
+	var writeErr error
+	err := t.EnumerateRaw(nil, nil, 0, false, func(re *storage.RawEntry) bool {
+		writeErr = writePair(bw, re.Key, re.Value)
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return bw.Flush()
+}
+
+// LoadPairs sets entries without expiration from records written by DumpPairs until the end of the stream and returns their number,
+// a truncated record is an error
+func (t *inmemoryStorage) LoadPairs(r io.Reader) (int, error) {
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+
+	cnt := 0
+	for {
+		key, err := readChunk(br, t.conf.MaxKeyLength, ErrKeyTooLong)
+		if err == io.EOF {
+			return cnt, nil
+		}
+		if err != nil {
+			return cnt, fmt.Errorf("pair %d: %w", cnt, err)
+		}
+		value, err := readChunk(br, t.conf.MaxValueSize, ErrValueTooLarge)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return cnt, fmt.Errorf("pair %d: %w", cnt, err)
+		}
+
+		if err := t.setPair(t.rawKey(key), value); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+}
+
+func (t *inmemoryStorage) setPair(k string, value []byte) error {
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+	return t.put(k, value, t.versionOf(k)+1, cache.NoExpiration)
+}
+
+func writePair(w io.Writer, key, value []byte) error {
+	var size [4]byte
+	for _, chunk := range [][]byte{key, value} {
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk reads the length prefixed chunk, io.EOF is returned only if the stream ends before the chunk.
+// Lengths above the positive limit are rejected with the given error, the buffer grows with the data read,
+// so a corrupted length of a short stream does not allocate it at once
+func readChunk(r io.Reader, limit int, tooLarge error) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(size[:]))
+	if limit > 0 && n > int64(limit) {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", tooLarge, n, limit)
+	}
+	var chunk bytes.Buffer
+	if _, err := io.CopyN(&chunk, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return chunk.Bytes(), nil
+}
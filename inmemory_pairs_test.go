@@ -0,0 +1,65 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDumpAndLoadPairs(t *testing.T) {
+
+	src := newTestStorage(t)
+	fillKeys(t, src, 50)
+	if err := src.SetRaw([]byte("empty"), []byte{}, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.DumpPairs(&buf); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	dst := newTestStorage(t)
+	n, err := dst.LoadPairs(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n != 51 {
+		t.Fatalf("loaded %d pairs, expected 51", n)
+	}
+
+	expected, _ := src.Snapshot()
+	loaded, _ := dst.Snapshot()
+	if len(loaded) != len(expected) {
+		t.Fatalf("loaded %d entries, expected %d", len(loaded), len(expected))
+	}
+	for key, value := range expected {
+		if !bytes.Equal(loaded[key], value) {
+			t.Fatalf("key %q loaded as %q, expected %q", key, loaded[key], value)
+		}
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-1]
+	if _, err := newTestStorage(t).LoadPairs(bytes.NewReader(truncated)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream returned %v", err)
+	}
+}
+
+func TestLoadPairsCorruptedLength(t *testing.T) {
+
+	s := newTestStorage(t)
+	// the length of the key claims 4GiB in a 5 byte stream
+	if _, err := s.LoadPairs(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 'k'})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("corrupted length returned %v", err)
+	}
+
+	limited := newTestStorage(t, WithMaxKeyLength(4))
+	if _, err := limited.LoadPairs(bytes.NewReader([]byte{0, 0, 0, 5, 'k'})); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("key above the limit returned %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sort"
+	"strings"
+)
+
+// sortedKeys keeps keys in lexicographic order to find keys with a prefix by binary search, it is guarded by the lock of lruList
+type sortedKeys struct {
+	keys []string
+}
+
+func newSortedKeys(capacity int) *sortedKeys {
+	return &sortedKeys{keys: make([]string, 0, capacity)}
+}
+
+// insert adds the key if it is absent
+func (t *sortedKeys) insert(k string) {
+	i := sort.SearchStrings(t.keys, k)
+	if i < len(t.keys) && t.keys[i] == k {
+		return
+	}
+	t.keys = append(t.keys, "")
+	copy(t.keys[i+1:], t.keys[i:])
+	t.keys[i] = k
+}
+
+func (t *sortedKeys) remove(k string) {
+	i := sort.SearchStrings(t.keys, k)
+	if i < len(t.keys) && t.keys[i] == k {
+		copy(t.keys[i:], t.keys[i+1:])
+		t.keys[len(t.keys)-1] = ""
+		t.keys = t.keys[:len(t.keys)-1]
+	}
+}
+
+// forEachPrefix calls the callback for keys with the prefix in lexicographic order until it returns false
+func (t *sortedKeys) forEachPrefix(prefix string, cb func(k string) bool) {
+	for i := sort.SearchStrings(t.keys, prefix); i < len(t.keys) && strings.HasPrefix(t.keys[i], prefix); i++ {
+		if !cb(t.keys[i]) {
+			return
+		}
+	}
+}
+
+// forEachFrom calls the callback for keys with the prefix at or after the key from in lexicographic order until it returns false
+func (t *sortedKeys) forEachFrom(prefix, from string, cb func(k string) bool) {
+	if from < prefix {
+		from = prefix
+	}
+	for i := sort.SearchStrings(t.keys, from); i < len(t.keys) && strings.HasPrefix(t.keys[i], prefix); i++ {
+		if !cb(t.keys[i]) {
+			return
+		}
+	}
+}
+
+// forEachPrefixReverse calls the callback for keys with the prefix in reverse lexicographic order until it returns false
+func (t *sortedKeys) forEachPrefixReverse(prefix string, cb func(k string) bool) {
+	i := sort.SearchStrings(t.keys, prefix)
+	// keys with the prefix follow each other starting from i
+	j := i + sort.Search(len(t.keys)-i, func(n int) bool {
+		return !strings.HasPrefix(t.keys[i+n], prefix)
+	})
+	for j--; j >= i; j-- {
+		if !cb(t.keys[j]) {
+			return
+		}
+	}
+}
+
+// literalPrefix returns the part of the glob pattern before the first wildcard
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
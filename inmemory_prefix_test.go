@@ -0,0 +1,45 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"go.arpabet.com/storage"
+	"testing"
+)
+
+func BenchmarkPrefixEnumeration(b *testing.B) {
+
+	for _, options := range [][]Option{nil, {WithPrefixIndex()}} {
+		name := "scan"
+		if options != nil {
+			name = "index"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestStorage(b, options...)
+			for i := 0; i < 100000; i++ {
+				if err := s.SetRaw([]byte(fmt.Sprintf("other:%06d", i)), []byte("v"), 0); err != nil {
+					b.Fatalf("set: %v", err)
+				}
+			}
+			for i := 0; i < 10; i++ {
+				if err := s.SetRaw([]byte(fmt.Sprintf("wanted:%d", i)), []byte("v"), 0); err != nil {
+					b.Fatalf("set: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				visited := 0
+				err := s.EnumerateRaw([]byte("wanted:"), nil, 0, true, func(*storage.RawEntry) bool {
+					visited++
+					return true
+				})
+				if err != nil || visited != 10 {
+					b.Fatalf("enumerate visited %d, error %v", visited, err)
+				}
+			}
+		})
+	}
+}
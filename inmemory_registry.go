@@ -0,0 +1,39 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// names are storages created with WithUniqueNameRegistry and not destroyed yet
+var names = struct {
+	sync.Mutex
+	used map[string]bool
+}{used: make(map[string]bool)}
+
+// register reserves the name of the storage or reports that it is used
+func (t *inmemoryStorage) register() error {
+	names.Lock()
+	defer names.Unlock()
+	if names.used[t.name] {
+		return fmt.Errorf("%w: %q is used by another storage", ErrInvalidName, t.name)
+	}
+	names.used[t.name] = true
+	atomic.StoreInt32(&t.unique, 1)
+	return nil
+}
+
+// unregister releases the name reserved by register, safe to call many times
+func (t *inmemoryStorage) unregister() {
+	if !atomic.CompareAndSwapInt32(&t.unique, 1, 0) {
+		return
+	}
+	names.Lock()
+	defer names.Unlock()
+	delete(names.used, t.name)
+}
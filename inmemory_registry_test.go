@@ -0,0 +1,37 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEmptyName(t *testing.T) {
+	if _, err := NewE(""); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("empty name returned %v", err)
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+
+	first, err := NewE("registry-test", WithUniqueNameRegistry())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := NewE("registry-test", WithUniqueNameRegistry()); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("duplicate name returned %v", err)
+	}
+
+	// the name is free again after Destroy
+	if err := first.Destroy(); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	second, err := NewE("registry-test", WithUniqueNameRegistry())
+	if err != nil {
+		t.Fatalf("create after destroy: %v", err)
+	}
+	second.Destroy()
+}
@@ -0,0 +1,166 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"go.arpabet.com/storage"
+	"io"
+)
+
+// Serializer defines the format of Backup and Restore streams, Ttl of entries is the remaining time in seconds
+type Serializer interface {
+	Encode(w io.Writer, entries []storage.RawEntry) error
+	Decode(r io.Reader) ([]storage.RawEntry, error)
+}
+
+// MetaSerializer is implemented by serializers keeping tags of entries, backups made with other serializers lose tags
+type MetaSerializer interface {
+	EncodeEntries(w io.Writer, entries []BackupEntry) error
+	DecodeEntries(r io.Reader) ([]BackupEntry, error)
+}
+
+// BackupEntry is the record of Backup and Restore streams, Ttl is the remaining time in seconds, zero or negative means no expiration.
+// Fields repeat storage.RawEntry, so streams written before tags were added decode as well
+type BackupEntry struct {
+	Key     []byte
+	Value   []byte
+	Ttl     int
+	Version int64
+	Meta    map[string]string `json:",omitempty"`
+}
+
+// backupMagic starts every gob backup stream written by this package, streams without it are go-cache dumps
+var backupMagic = []byte("IMSB")
+
+// errLegacyDump is returned by the gob serializer for streams written by go-cache Save
+var errLegacyDump = errors.New("stream is a go-cache dump")
+
+// GobSerializer is the default serializer writing gob encoded entries
+type GobSerializer struct{}
+
+func (GobSerializer) EncodeEntries(w io.Writer, entries []BackupEntry) error {
+
+	if _, err := w.Write(backupMagic); err != nil {
+		return err
+	}
+
+	enc := gob.NewEncoder(w)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (GobSerializer) DecodeEntries(r io.Reader) ([]BackupEntry, error) {
+
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	if magic, err := br.Peek(len(backupMagic)); err != nil || !bytes.Equal(magic, backupMagic) {
+		return nil, errLegacyDump
+	}
+	if _, err := br.Discard(len(backupMagic)); err != nil {
+		return nil, err
+	}
+
+	var entries []BackupEntry
+	dec := gob.NewDecoder(br)
+	for {
+		var re BackupEntry
+		if err := dec.Decode(&re); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		entries = append(entries, re)
+	}
+}
+
+func (s GobSerializer) Encode(w io.Writer, entries []storage.RawEntry) error {
+	return s.EncodeEntries(w, fromRawEntries(entries))
+}
+
+func (s GobSerializer) Decode(r io.Reader) ([]storage.RawEntry, error) {
+	entries, err := s.DecodeEntries(r)
+	return toRawEntries(entries), err
+}
+
+// JSONSerializer writes entries as a human readable JSON array, keys and values are base64 encoded
+type JSONSerializer struct{}
+
+func (JSONSerializer) EncodeEntries(w io.Writer, entries []BackupEntry) error {
+	if entries == nil {
+		entries = []BackupEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func (JSONSerializer) DecodeEntries(r io.Reader) ([]BackupEntry, error) {
+	var entries []BackupEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s JSONSerializer) Encode(w io.Writer, entries []storage.RawEntry) error {
+	return s.EncodeEntries(w, fromRawEntries(entries))
+}
+
+func (s JSONSerializer) Decode(r io.Reader) ([]storage.RawEntry, error) {
+	entries, err := s.DecodeEntries(r)
+	return toRawEntries(entries), err
+}
+
+// encodeEntries writes entries with tags if the serializer keeps them
+func encodeEntries(s Serializer, w io.Writer, entries []BackupEntry) error {
+	if ms, ok := s.(MetaSerializer); ok {
+		return ms.EncodeEntries(w, entries)
+	}
+	return s.Encode(w, toRawEntries(entries))
+}
+
+// decodeEntries reads entries with tags if the serializer keeps them
+func decodeEntries(s Serializer, r io.Reader) ([]BackupEntry, error) {
+	if ms, ok := s.(MetaSerializer); ok {
+		return ms.DecodeEntries(r)
+	}
+	entries, err := s.Decode(r)
+	return fromRawEntries(entries), err
+}
+
+func fromRawEntries(entries []storage.RawEntry) []BackupEntry {
+	if entries == nil {
+		return nil
+	}
+	list := make([]BackupEntry, len(entries))
+	for i, re := range entries {
+		list[i] = BackupEntry{Key: re.Key, Value: re.Value, Ttl: re.Ttl, Version: re.Version}
+	}
+	return list
+}
+
+func toRawEntries(entries []BackupEntry) []storage.RawEntry {
+	if entries == nil {
+		return nil
+	}
+	list := make([]storage.RawEntry, len(entries))
+	for i, be := range entries {
+		list[i] = storage.RawEntry{Key: be.Key, Value: be.Value, Ttl: be.Ttl, Version: be.Version}
+	}
+	return list
+}
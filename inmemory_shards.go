@@ -0,0 +1,76 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+// shards partitions keys across independent caches by hash of the key to reduce lock contention
+type shards []*cache.Cache
+
+// newShards creates n caches without janitors, capacity is the expected total number of entries
+func newShards(n int, defaultExpiration time.Duration, capacity int) shards {
+	if n < 1 {
+		n = 1
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	list := make(shards, n)
+	for i := range list {
+		list[i] = cache.NewFrom(defaultExpiration, 0, make(map[string]cache.Item, capacity/n))
+	}
+	return list
+}
+
+// of returns the cache holding the key
+func (t shards) of(k string) *cache.Cache {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return t[fnv32a(k)%uint32(len(t))]
+}
+
+// items returns not expired items of all shards
+func (t shards) items() map[string]cache.Item {
+	if len(t) == 1 {
+		return t[0].Items()
+	}
+	all := make(map[string]cache.Item)
+	for _, c := range t {
+		for key, item := range c.Items() {
+			all[key] = item
+		}
+	}
+	return all
+}
+
+func (t shards) itemCount() int {
+	cnt := 0
+	for _, c := range t {
+		cnt += c.ItemCount()
+	}
+	return cnt
+}
+
+func (t shards) deleteExpired() {
+	for _, c := range t {
+		c.DeleteExpired()
+	}
+}
+
+func (t shards) flush() {
+	for _, c := range t {
+		c.Flush()
+	}
+}
+
+func (t shards) onEvicted(f func(string, interface{})) {
+	for _, c := range t {
+		c.OnEvicted(f)
+	}
+}
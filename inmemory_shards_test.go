@@ -0,0 +1,39 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkShardsParallel(b *testing.B) {
+
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%d", i))
+	}
+	value := []byte("value")
+
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newTestStorage(b, WithShards(shards))
+			defer s.Destroy()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						s.SetRaw(key, value, 0)
+					} else {
+						s.GetRaw(key, nil, nil, false)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"go.arpabet.com/storage"
+	"sync/atomic"
+)
+
+// Snapshot returns a point-in-time copy of all not expired entries, entries are captured under the view lock blocking writers
+func (t *inmemoryStorage) Snapshot() (map[string][]byte, error) {
+
+	list := t.matchEntries(t.ns, func(string) bool {
+		return true
+	})
+
+	now := t.conf.Clock.Now()
+	snapshot := make(map[string][]byte, len(list))
+	for _, ke := range list {
+		if ke.e.expired(now) {
+			continue
+		}
+		value, err := t.decode(ke.e)
+		if err != nil {
+			return nil, err
+		}
+		snapshot[t.userKey(ke.key)] = value
+	}
+	return snapshot, nil
+}
+
+// snapshotChunk is the number of keys SnapshotTo captures at once
+const snapshotChunk = 1024
+
+// SnapshotTo streams entries to the callback until it returns false walking the key index in chunks, only one chunk of entries
+// is captured at a time to bound memory of large stores, so unlike Snapshot the stream is consistent only within every chunk
+func (t *inmemoryStorage) SnapshotTo(cb func(key, value []byte) bool) error {
+
+	next := t.keyChunks(t.ns, snapshotChunk, func(string) bool {
+		return true
+	})
+
+	for keys := next(); len(keys) > 0; keys = next() {
+		now := t.conf.Clock.Now()
+		for _, ke := range t.captureEntries(keys) {
+			if ke.e.expired(now) {
+				continue
+			}
+			value, err := t.decode(ke.e)
+			if err != nil {
+				return err
+			}
+			if !cb([]byte(t.userKey(ke.key)), value) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Clone creates an independent storage with the same configuration and a deep copy of all entries keeping their expirations and versions,
+// entries are captured at once like by Snapshot
+func (t *inmemoryStorage) Clone(name string) storage.ManagedStorage {
+
+	clone := openStorage(name, t.conf)
+
+	list := t.matchEntries(t.ns, func(string) bool {
+		return true
+	})
+
+	now := t.conf.Clock.Now()
+	for _, ke := range list {
+		e := ke.e
+		if e.expired(now) {
+			continue
+		}
+		value := make([]byte, len(e.Value))
+		copy(value, e.Value)
+		clone.store(ke.key, &entry{
+			lastAccess: atomic.LoadInt64(&e.lastAccess),
+			Value:      value,
+			Version:    e.Version,
+			Expiration: e.Expiration,
+			Compressed: e.Compressed,
+			Meta:       copyMeta(e.Meta),
+		})
+	}
+
+	return clone
+}
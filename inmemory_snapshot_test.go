@@ -0,0 +1,96 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCloneIsIndependent(t *testing.T) {
+
+	s := newTestStorage(t)
+	for _, key := range []string{"a", "b"} {
+		if err := s.SetRaw([]byte(key), []byte("original"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	clone := s.Clone("clone").(*inmemoryStorage)
+	defer clone.Destroy()
+
+	if err := clone.SetRaw([]byte("a"), []byte("changed"), 0); err != nil {
+		t.Fatalf("set clone: %v", err)
+	}
+	if err := clone.SetRaw([]byte("c"), []byte("added"), 0); err != nil {
+		t.Fatalf("set clone: %v", err)
+	}
+	if err := clone.RemoveRaw([]byte("b")); err != nil {
+		t.Fatalf("remove from clone: %v", err)
+	}
+
+	original, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if len(original) != 2 || string(original["a"]) != "original" || string(original["b"]) != "original" {
+		t.Fatalf("original changed: %q", original)
+	}
+
+	cloned, err := clone.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot clone: %v", err)
+	}
+	if len(cloned) != 2 || string(cloned["a"]) != "changed" || string(cloned["c"]) != "added" {
+		t.Fatalf("unexpected clone: %q", cloned)
+	}
+}
+
+func TestSnapshotToChunks(t *testing.T) {
+
+	const entries = 2*snapshotChunk + 10
+
+	for _, options := range [][]Option{nil, {WithPrefixIndex()}} {
+
+		s := newTestStorage(t, options...)
+		for i := 0; i < entries; i++ {
+			key := []byte(fmt.Sprintf("key%06d", i))
+			if err := s.SetRaw(key, key, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+		}
+
+		seen := make(map[string]bool, entries)
+		err := s.SnapshotTo(func(key, value []byte) bool {
+			if seen[string(key)] {
+				t.Fatalf("key %q streamed twice", key)
+			}
+			seen[string(key)] = true
+			if string(value) != string(key) {
+				t.Fatalf("key %q streamed with value %q", key, value)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		if len(seen) != entries {
+			t.Fatalf("streamed %d of %d entries", len(seen), entries)
+		}
+
+		streamed := 0
+		err = s.SnapshotTo(func(key, value []byte) bool {
+			streamed++
+			return streamed < 3
+		})
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		if streamed != 3 {
+			t.Fatalf("streamed %d entries after the callback stopped", streamed)
+		}
+		s.Destroy()
+	}
+}
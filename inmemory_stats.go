@@ -0,0 +1,107 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of operation counters of the storage
+type Stats struct {
+	Gets      uint64
+	Hits      uint64
+	Misses    uint64
+	Sets      uint64
+	Removals  uint64
+	Evictions uint64
+	// DroppedEvents counts watch events lost because consumers were behind
+	DroppedEvents uint64
+	// Scans counts enumerations and other operations walking keys, ScannedKeys and ScanTime are their total visited keys and duration
+	Scans       uint64
+	ScannedKeys uint64
+	ScanTime    time.Duration
+}
+
+// HitRatio returns share of gets that found the key
+func (s Stats) HitRatio() float64 {
+	if s.Gets == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Gets)
+}
+
+// counters are updated atomically, keep them 64-bit aligned
+type counters struct {
+	gets      uint64
+	hits      uint64
+	misses    uint64
+	sets      uint64
+	removals  uint64
+	evictions uint64
+	scans     uint64
+	scanned   uint64
+	scanNanos uint64
+}
+
+func (c *counters) hit() {
+	atomic.AddUint64(&c.gets, 1)
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *counters) miss() {
+	atomic.AddUint64(&c.gets, 1)
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *counters) scan(keys int, d time.Duration) {
+	atomic.AddUint64(&c.scans, 1)
+	atomic.AddUint64(&c.scanned, uint64(keys))
+	atomic.AddUint64(&c.scanNanos, uint64(d))
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Gets:        atomic.LoadUint64(&c.gets),
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Sets:        atomic.LoadUint64(&c.sets),
+		Removals:    atomic.LoadUint64(&c.removals),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Scans:       atomic.LoadUint64(&c.scans),
+		ScannedKeys: atomic.LoadUint64(&c.scanned),
+		ScanTime:    time.Duration(atomic.LoadUint64(&c.scanNanos)),
+	}
+}
+
+// Stats returns current values of operation counters
+func (t *inmemoryStorage) Stats() Stats {
+	s := t.stats.snapshot()
+	s.DroppedEvents = atomic.LoadUint64(&t.watchers.dropped)
+	return s
+}
+
+// Collect returns metrics named in Prometheus style to be exported by a custom collector
+func (t *inmemoryStorage) Collect() map[string]float64 {
+	s := t.Stats()
+	return map[string]float64{
+		"inmemory_entries":            float64(t.Len()),
+		"inmemory_size_bytes":         float64(t.SizeBytes()),
+		"inmemory_gets_total":         float64(s.Gets),
+		"inmemory_hits_total":         float64(s.Hits),
+		"inmemory_misses_total":       float64(s.Misses),
+		"inmemory_sets_total":         float64(s.Sets),
+		"inmemory_removals_total":     float64(s.Removals),
+		"inmemory_evictions_total":    float64(s.Evictions),
+		"inmemory_scans_total":        float64(s.Scans),
+		"inmemory_scanned_keys_total": float64(s.ScannedKeys),
+		"inmemory_scan_seconds_total": s.ScanTime.Seconds(),
+	}
+}
+
+// observe passes the finished operation to the metrics hook, it is deferred only when the hook is set
+func (t *inmemoryStorage) observe(op string, key []byte, start time.Time, err *error) {
+	t.conf.MetricsHook(op, key, time.Since(start), *err)
+}
@@ -0,0 +1,151 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"context"
+	"errors"
+	"go.arpabet.com/storage"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsCounters(t *testing.T) {
+
+	s := newTestStorage(t, WithMaxEntries(2))
+
+	for _, key := range []string{"a", "b"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if _, err := s.GetRaw([]byte("a"), nil, nil, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := s.GetRaw([]byte("absent"), nil, nil, false); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	// evicts b, the least recently used key
+	if err := s.SetRaw([]byte("c"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.RemoveRaw([]byte("a")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	// absent keys are not counted as removals
+	if err := s.RemoveRaw([]byte("a")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	expected := Stats{Gets: 2, Hits: 1, Misses: 1, Sets: 3, Removals: 1, Evictions: 1}
+	stats := s.Stats()
+	stats.Scans, stats.ScannedKeys, stats.ScanTime = 0, 0, 0
+	if stats != expected {
+		t.Fatalf("stats %+v, expected %+v", stats, expected)
+	}
+	if ratio := stats.HitRatio(); ratio != 0.5 {
+		t.Fatalf("hit ratio %v", ratio)
+	}
+}
+
+type hookCall struct {
+	op     string
+	key    string
+	failed bool
+}
+
+func TestMetricsHook(t *testing.T) {
+
+	var mu sync.Mutex
+	var calls []hookCall
+	s := newTestStorage(t, WithMetricsHook(func(op string, key []byte, dur time.Duration, err error) {
+		if dur < 0 {
+			t.Errorf("negative duration of %s", op)
+		}
+		mu.Lock()
+		calls = append(calls, hookCall{op: op, key: string(key), failed: err != nil})
+		mu.Unlock()
+	}))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if _, err := s.GetRaw([]byte("k"), nil, nil, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := s.GetRaw([]byte("absent"), nil, nil, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get of absent key returned %v", err)
+	}
+	if _, err := s.IncrementRaw([]byte("n"), 1, 0, 0); err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	if _, err := s.RenameRaw([]byte("k"), []byte("k2")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := s.EnumerateRaw([]byte("k"), nil, 0, true, func(*storage.RawEntry) bool { return true }); err != nil {
+		t.Fatalf("enumerate: %v", err)
+	}
+	if err := s.EnumerateRawContext(context.Background(), []byte("k"), nil, 0, true, func(*storage.RawEntry) bool { return true }); err != nil {
+		t.Fatalf("enumerate with context: %v", err)
+	}
+	if _, err := s.EnumerateRawLimit([]byte("k"), nil, 1, true, func(*storage.RawEntry) bool { return true }); err != nil {
+		t.Fatalf("enumerate with limit: %v", err)
+	}
+	if err := s.EnumerateRawReverse([]byte("k"), nil, 0, true, func(*storage.RawEntry) bool { return true }); err != nil {
+		t.Fatalf("enumerate in reverse: %v", err)
+	}
+	if _, err := s.FetchKeysRawContext(context.Background(), []byte("k"), 0); err != nil {
+		t.Fatalf("fetch keys with context: %v", err)
+	}
+	if err := s.RemoveRaw([]byte("k2")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	expected := []hookCall{
+		{op: "SetRaw", key: "k"},
+		{op: "GetRaw", key: "k"},
+		{op: "GetRaw", key: "absent", failed: true},
+		{op: "IncrementRaw", key: "n"},
+		{op: "RenameRaw", key: "k"},
+		{op: "EnumerateRaw", key: "k"},
+		{op: "EnumerateRawContext", key: "k"},
+		{op: "EnumerateRawLimit", key: "k"},
+		{op: "EnumerateRawReverse", key: "k"},
+		{op: "FetchKeysRawContext", key: "k"},
+		{op: "RemoveRaw", key: "k2"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("hook calls %+v, expected %+v", calls, expected)
+	}
+}
+
+func TestScanCounters(t *testing.T) {
+
+	s := newTestStorage(t)
+	fillKeys(t, s, 20)
+
+	before := s.Stats()
+	if err := s.EnumerateRaw(nil, nil, 0, true, func(*storage.RawEntry) bool { return true }); err != nil {
+		t.Fatalf("enumerate: %v", err)
+	}
+	after := s.Stats()
+
+	if after.Scans != before.Scans+1 {
+		t.Fatalf("scans went from %d to %d", before.Scans, after.Scans)
+	}
+	if after.ScannedKeys != before.ScannedKeys+20 {
+		t.Fatalf("scanned keys went from %d to %d", before.ScannedKeys, after.ScannedKeys)
+	}
+	if after.ScanTime < before.ScanTime {
+		t.Fatalf("scan time went back")
+	}
+	if metrics := s.Collect(); metrics["inmemory_scans_total"] != float64(after.Scans) {
+		t.Fatalf("collected scans %v", metrics["inmemory_scans_total"])
+	}
+}
@@ -5,30 +5,246 @@
 package inmemorystorage
 
 import (
+	"encoding/binary"
+	"fmt"
 	"go.arpabet.com/storage"
-	"io"
-	"os"
 	"github.com/patrickmn/go-cache"
-	"strings"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type inmemoryStorage struct {
+	modSeq    uint64       // logical modification counter, keep first for atomic alignment
+	stats     counters
+	watchers  watchers
 	name      string
-	cache     *cache.Cache
+	ns        string       // prefix of cache keys from the namespace
+	shards    shards
+	conf      *Config
+	locks     keyLocks     // serializes read-modify-write of the same key
+	lru       *lruList     // tracks recency and sizes of entries
+	janitor   *janitor     // nil with zero or negative CleanupInterval
+	saver     *janitor     // writes periodic backups, nil without WithAutoBackup
+	readOnly  int32        // atomic flag rejecting writes
+	unique    int32        // atomic flag of the name reserved by WithUniqueNameRegistry
+	view      sync.RWMutex // shared by writers, held exclusively while a point-in-time view is captured
+	freeze    freezer      // blocks writers between Freeze and Thaw
 }
 
 func NewDefault(name string) storage.ManagedStorage {
 	return New(name)
 }
 
+// New creates the storage, it panics if the storage can not be created, NewE returns the error instead
 func New(name string, options ...Option) storage.ManagedStorage {
-	cache := OpenDatabase(options...)
-	return &inmemoryStorage {name: name, cache: cache}
+	t, err := NewE(name, options...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// NewE creates the storage and loads the startup file if it is configured, invalid options are reported by ErrInvalidOption
+// and empty or already used with WithUniqueNameRegistry names by ErrInvalidName
+func NewE(name string, options ...Option) (storage.ManagedStorage, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty name", ErrInvalidName)
+	}
+	conf := newConfig(options...)
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	t := openStorage(name, conf)
+	if conf.UniqueName {
+		if err := t.register(); err != nil {
+			t.Destroy()
+			return nil, err
+		}
+	}
+	if conf.StartupLoadFile != "" {
+		if err := t.loadFile(conf.StartupLoadFile); err != nil {
+			t.Destroy()
+			return nil, err
+		}
+	}
+	if conf.AutoBackupPath != "" {
+		t.saver = startJanitor(conf.BackupInterval, t.autoSave)
+	}
+	return t, nil
+}
+
+func openStorage(name string, conf *Config) *inmemoryStorage {
+	// the storage runs own janitor to be able to stop it on Destroy
+	t := newStorage(name, newShards(conf.Shards, conf.DefaultExpiration, conf.InitialCapacity), conf)
+	t.SetReadOnly(conf.ReadOnly)
+	if conf.CleanupInterval > 0 {
+		t.janitor = startJanitor(conf.CleanupInterval, t.deleteExpired)
+	}
+	return t
+}
+
+// FromCache wraps the existing cache, storages sharing the same cache should be isolated by WithNamespace.
+// Entries are written without expiration in the cache, so the storage runs own janitor every CleanupInterval until Destroy
+func FromCache(name string, c *cache.Cache, options ...Option) storage.ManagedStorage {
+	conf := newConfig(options...)
+	if err := conf.validate(); err != nil {
+		panic(err)
+	}
+	t := newStorage(name, shards{c}, conf)
+	t.SetReadOnly(conf.ReadOnly)
+	if conf.CleanupInterval > 0 {
+		t.janitor = startJanitor(conf.CleanupInterval, t.deleteExpired)
+	}
+	return t
+}
+
+func newStorage(name string, s shards, conf *Config) *inmemoryStorage {
+	t := &inmemoryStorage {name: name, ns: namespacePrefix(conf.Namespace), shards: s, conf: conf, lru: newLRUList(conf.InitialCapacity, conf.PrefixIndex, conf.EvictionPolicy)}
+	t.reindex()
+	s.onEvicted(t.onEvicted)
+	return t
+}
+
+// reindex registers entries added to the cache directly, like on load of a go-cache dump
+func (t *inmemoryStorage) reindex() {
+	for key, item := range t.shards.items() {
+		if !t.owns(key) {
+			continue
+		}
+		if e, ok := asEntry(item.Object); ok {
+			t.lru.update(key, entrySize(key, e.Value))
+		}
+	}
+}
+
+// Len returns number of entries in the storage including expired ones not yet removed by the janitor
+func (t *inmemoryStorage) Len() int {
+	if t.ns != "" {
+		// the cache is shared, only keys of the namespace are indexed
+		return t.lru.len()
+	}
+	return t.shards.itemCount()
+}
+
+// LenWithPrefix returns number of not expired entries with the prefix
+func (t *inmemoryStorage) LenWithPrefix(prefix []byte) int {
+	cnt, _ := t.CountWithPrefix(prefix)
+	return cnt
+}
+
+// CountWithPrefix counts not expired entries with the prefix walking the key index without copying the cache
+func (t *inmemoryStorage) CountWithPrefix(prefix []byte) (int, error) {
+	prefixStr := t.rawKey(prefix)
+	cnt := 0
+	t.lru.forEachPrefix(prefixStr, func(k string) bool {
+		if _, ok := t.lookup(k); ok {
+			cnt++
+		}
+		return true
+	})
+	return cnt, nil
+}
+
+// lookup returns the entry if it is present and not expired by the storage clock
+func (t *inmemoryStorage) lookup(k string) (*entry, bool) {
+	if obj, ok := t.shards.of(k).Get(k); ok {
+		return t.live(obj, t.conf.Clock.Now())
+	}
+	return nil, false
+}
+
+// live converts the cached object to not expired entry
+func (t *inmemoryStorage) live(obj interface{}, now time.Time) (*entry, bool) {
+	if e, ok := asEntry(obj); ok && !e.expired(now) {
+		return e, true
+	}
+	return nil, false
+}
+
+// deleteExpired removes entries expired by the storage clock and the ones expired in the cache itself
+func (t *inmemoryStorage) deleteExpired() {
+	t.collectExpired()
+}
+
+// DeleteExpiredCollect runs the expiry sweep and returns keys it removed, it is safe to call concurrently with other operations
+func (t *inmemoryStorage) DeleteExpiredCollect() [][]byte {
+	return t.collectExpired()
 }
 
-func FromCache(name string, c *cache.Cache) storage.ManagedStorage {
-	return &inmemoryStorage {name: name, cache: c}
+// collectExpired removes expired entries and returns their storage keys, entries expired in the cache itself are not reported
+func (t *inmemoryStorage) collectExpired() [][]byte {
+
+	t.shards.deleteExpired()
+
+	now := t.conf.Clock.Now()
+	var expired []string
+	t.lru.forEach(func(k string) bool {
+		if obj, ok := t.shards.of(k).Get(k); ok {
+			if e, ok := asEntry(obj); ok && e.expired(now) {
+				expired = append(expired, k)
+			}
+		}
+		return true
+	})
+
+	var removed [][]byte
+	for _, k := range expired {
+		if t.deleteIfExpired(k, now) {
+			removed = append(removed, []byte(t.userKey(k)))
+		}
+	}
+	return removed
+}
+
+// deleteIfExpired removes the key if it is still expired under the lock and returns true if it was removed
+func (t *inmemoryStorage) deleteIfExpired(k string, now time.Time) bool {
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if obj, ok := t.shards.of(k).Get(k); ok {
+		if e, ok := asEntry(obj); ok && e.expired(now) {
+			t.delete(k, ReasonExpired)
+			return true
+		}
+	}
+	return false
+}
+
+// SetReadOnly toggles read-only mode, where all writes fail with ErrReadOnly while reads and enumerations work
+func (t *inmemoryStorage) SetReadOnly(readOnly bool) {
+	var flag int32
+	if readOnly {
+		flag = 1
+	}
+	atomic.StoreInt32(&t.readOnly, flag)
+}
+
+func (t *inmemoryStorage) writable() error {
+	if atomic.LoadInt32(&t.readOnly) != 0 {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// EntryOverhead approximates bytes taken by bookkeeping of a single entry in the cache and the indexes
+const EntryOverhead = 128
+
+// SizeBytes returns approximate number of bytes taken by keys, values and EntryOverhead per entry, it is maintained on every write
+func (t *inmemoryStorage) SizeBytes() int64 {
+	return t.lru.size()
+}
+
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value) + EntryOverhead)
+}
+
+// limited returns true if eviction by entry count or size is enabled
+func (t *inmemoryStorage) limited() bool {
+	return t.conf.MaxEntries > 0 || t.conf.MaxMemoryBytes > 0
 }
 
 func (t* inmemoryStorage) BeanName() string {
@@ -36,6 +252,13 @@ func (t* inmemoryStorage) BeanName() string {
 }
 
 func (t* inmemoryStorage) Destroy() error {
+	if t.janitor != nil {
+		t.janitor.stop()
+	}
+	if t.saver != nil {
+		t.saver.stop()
+	}
+	t.unregister()
 	return nil
 }
 
@@ -63,22 +286,280 @@ func (t* inmemoryStorage) Enumerate() *storage.EnumerateOperation {
 	return &storage.EnumerateOperation{Storage: t}
 }
 
-func (t* inmemoryStorage) GetRaw(key []byte, ttlPtr *int, versionPtr *int64, required bool) ([]byte, error) {
-	return t.getImpl(key, required)
+func (t* inmemoryStorage) GetRaw(key []byte, ttlPtr *int, versionPtr *int64, required bool) (value []byte, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("GetRaw", key, time.Now(), &err)
+	}
+	return t.getImpl(key, ttlPtr, versionPtr, required)
 }
 
-func (t* inmemoryStorage) SetRaw(key, value []byte, ttlSeconds int) error {
+// GetRawFound returns the value with a flag if the key is present, so an empty value is told apart from an absent key
+func (t *inmemoryStorage) GetRawFound(key []byte) (value []byte, found bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("GetRawFound", key, time.Now(), &err)
+	}
+	return t.getFound(key, nil, nil)
+}
 
-	ttl := cache.NoExpiration
+func (t* inmemoryStorage) SetRaw(key, value []byte, ttlSeconds int) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SetRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	return t.put(k, value, t.versionOf(k) + 1, ttl)
+}
+
+// SetRawAt stores the value expiring at the given instant by the storage clock, a deadline in the past removes the key
+func (t *inmemoryStorage) SetRawAt(key, value []byte, expireAt time.Time) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SetRawAt", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ttl := expireAt.Sub(t.conf.Clock.Now())
+	if ttl <= 0 {
+		t.delete(k, ReasonDeleted)
+		return nil
+	}
+	return t.put(k, value, t.versionOf(k)+1, ttl)
+}
+
+// ttlDuration converts ttl in seconds to duration, values <= 0 mean no expiration
+func ttlDuration(ttlSeconds int) time.Duration {
 	if ttlSeconds > 0 {
-		ttl = time.Second * time.Duration(ttlSeconds)
+		return time.Second * time.Duration(ttlSeconds)
+	}
+	return cache.NoExpiration
+}
+
+// ttlOrDefault converts ttl in seconds to duration, values <= 0 mean the default expiration of the storage
+func (t *inmemoryStorage) ttlOrDefault(ttlSeconds int) time.Duration {
+	if ttlSeconds > 0 {
+		return t.jitter(time.Second * time.Duration(ttlSeconds))
+	}
+	return t.jitter(t.conf.DefaultExpiration)
+}
+
+// jitter randomly changes positive ttl by up to the configured fraction in both directions
+func (t *inmemoryStorage) jitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 || t.conf.TTLJitter <= 0 {
+		return ttl
+	}
+	jittered := ttl + time.Duration(float64(ttl)*t.conf.TTLJitter*(2*rand.Float64()-1))
+	if jittered <= 0 {
+		// zero would mean no expiration
+		return time.Nanosecond
+	}
+	return jittered
+}
+
+// expiration returns entry expiration for the ttl by the storage clock, zero for ttl <= 0
+func (t *inmemoryStorage) expiration(ttl time.Duration) int64 {
+	if ttl > 0 {
+		return t.conf.Clock.Now().Add(ttl).UnixNano()
+	}
+	return 0
+}
+
+// put stores the entry stamped with the next modification number, must be called under the lock.
+// Expiration is tracked by the entry itself against the storage clock, so the cache never expires it.
+func (t *inmemoryStorage) put(k string, value []byte, version int64, ttl time.Duration) error {
+	return t.putMeta(k, value, version, ttl, nil)
+}
+
+// putMeta is put attaching tags to the entry, must be called under the lock
+func (t *inmemoryStorage) putMeta(k string, value []byte, version int64, ttl time.Duration, meta map[string]string) error {
+	e, err := t.prepare(k, value, version, ttl, meta)
+	if err != nil {
+		return err
 	}
+	t.store(k, e)
+	return nil
+}
+
+// prepare validates and encodes the value to the entry without writing it, so callers can check several entries before the first write
+func (t *inmemoryStorage) prepare(k string, value []byte, version int64, ttl time.Duration, meta map[string]string) (*entry, error) {
+	if err := t.checkEntry([]byte(t.userKey(k)), value); err != nil {
+		return nil, err
+	}
+	data, compressed, err := t.encode(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkSize(k, data); err != nil {
+		return nil, err
+	}
+	if !compressed && t.conf.CopyOnWrite && data != nil {
+		// compressed values are already new slices
+		data = append([]byte(nil), data...)
+	}
+	return &entry{lastAccess: t.conf.Clock.Now().UnixNano(), Value: data, Version: version, Expiration: t.expiration(ttl), Compressed: compressed, Meta: meta}, nil
+}
 
-	t.cache.Set(string(key), value, ttl)
+// checkSize rejects the encoded entry larger than MaxMemoryBytes, evicting everything would not make room for it
+func (t *inmemoryStorage) checkSize(k string, data []byte) error {
+	if size := entrySize(k, data); t.conf.MaxMemoryBytes > 0 && size > t.conf.MaxMemoryBytes {
+		return fmt.Errorf("%w: entry takes %d bytes, MaxMemoryBytes is %d", ErrValueTooLarge, size, t.conf.MaxMemoryBytes)
+	}
 	return nil
 }
 
-func (t *inmemoryStorage) DoInTransaction(key []byte, cb func(entry *storage.RawEntry) bool) error {
+// checkEntry applies limits of the configuration and the validator to the entry before it is written
+func (t *inmemoryStorage) checkEntry(key, value []byte) error {
+	if t.conf.MaxKeyLength > 0 && len(key) > t.conf.MaxKeyLength {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLong, len(key), t.conf.MaxKeyLength)
+	}
+	if t.conf.MaxValueSize > 0 && len(value) > t.conf.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(value), t.conf.MaxValueSize)
+	}
+	if t.conf.Validator != nil {
+		return t.conf.Validator(key, value)
+	}
+	return nil
+}
+
+// store stamps the prepared entry with the next modification number and puts it to the cache updating the bookkeeping,
+// must be called under the lock
+func (t *inmemoryStorage) store(k string, e *entry) {
+	var old *entry
+	if t.conf.OnEvicted != nil {
+		old, _ = t.lookup(k)
+	}
+	t.freeze.enter()
+	t.view.RLock()
+	// the number is taken in the same critical section that publishes the entry, so a backup never misses it
+	e.Modified = atomic.AddUint64(&t.modSeq, 1)
+	t.shards.of(k).Set(k, e, cache.NoExpiration)
+	t.lru.update(k, entrySize(k, e.Value))
+	t.view.RUnlock()
+	t.freeze.leave()
+	atomic.AddUint64(&t.stats.sets, 1)
+	if t.watchers.active() {
+		t.watchers.notify(EventSet, t.userKey(k), t.plainValue(e))
+	}
+	if old != nil {
+		t.conf.OnEvicted([]byte(t.userKey(k)), t.plainValue(old), ReasonOverwritten)
+	}
+	if t.limited() {
+		t.evictOverCapacity(k)
+	}
+}
+
+// evictOverCapacity removes entries above the limits in the order of the eviction policy after the key was written.
+// Victims are deleted under their locks, keys locked by other operations are skipped, so the storage can stay above the limits until the next write
+func (t *inmemoryStorage) evictOverCapacity(written string) {
+	for {
+		var mu *keyMutex
+		victim, ok := t.lru.popOldest(t.conf.MaxEntries, t.conf.MaxMemoryBytes, func(k string) bool {
+			if k == written {
+				return false
+			}
+			mu = t.locks.of(k)
+			return mu.TryLock()
+		})
+		if !ok {
+			return
+		}
+		t.delete(victim, ReasonCapacity)
+		mu.Unlock()
+	}
+}
+
+// delete removes the key from the cache and passes the reason to the eviction callback after writers are let in,
+// so the callback can write while the storage is being frozen
+func (t *inmemoryStorage) delete(k string, reason EvictionReason) {
+	c := t.shards.of(k)
+	p := pendingDeletes.mark(c, k)
+	t.freeze.enter()
+	// the key leaves the index first, so views do not capture it anymore
+	t.view.RLock()
+	t.lru.remove(k)
+	t.view.RUnlock()
+	c.Delete(k)
+	t.freeze.leave()
+	obj, removed := pendingDeletes.unmark(c, k, p)
+	if !removed {
+		// absent or removed by a concurrent delete that counts it
+		return
+	}
+	if reason == ReasonDeleted {
+		atomic.AddUint64(&t.stats.removals, 1)
+	} else {
+		atomic.AddUint64(&t.stats.evictions, 1)
+	}
+	t.notifyEvicted(k, obj, reason)
+}
+
+// onEvicted is called by the cache for removed and expired entries, removals by delete are notified by it
+func (t *inmemoryStorage) onEvicted(k string, obj interface{}) {
+	c := t.shards.of(k)
+	if pendingDeletes.take(c, k, obj) {
+		return
+	}
+	if !t.owns(k) {
+		return
+	}
+	if _, found := c.Get(k); !found {
+		// the key could be written again right after removal
+		t.lru.remove(k)
+	}
+	t.notifyEvicted(k, obj, ReasonExpired)
+}
+
+// notifyEvicted passes the removed object to the eviction callback and watchers
+func (t *inmemoryStorage) notifyEvicted(k string, obj interface{}, reason EvictionReason) {
+	if t.conf.OnEvicted == nil && !t.watchers.active() {
+		return
+	}
+	e, ok := asEntry(obj)
+	if !ok {
+		return
+	}
+	value := t.plainValue(e)
+	if t.conf.OnEvicted != nil {
+		t.conf.OnEvicted([]byte(t.userKey(k)), value, reason)
+	}
+	if reason == ReasonExpired {
+		t.watchers.notify(EventExpire, t.userKey(k), value)
+	} else {
+		t.watchers.notify(EventRemove, t.userKey(k), value)
+	}
+}
+
+// versionOf returns current version of the key or zero if absent, must be called under the lock
+func (t *inmemoryStorage) versionOf(k string) int64 {
+	if e, ok := t.lookup(k); ok {
+		return e.Version
+	}
+	return 0
+}
+
+// DoInTransaction holds the lock of the key during the whole read-modify-write, callback must not access the storage
+func (t *inmemoryStorage) DoInTransaction(key []byte, cb func(entry *storage.RawEntry) bool) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("DoInTransaction", key, time.Now(), &err)
+	}
 
 	rawEntry := &storage.RawEntry {
 		Key: key,
@@ -86,110 +567,593 @@ func (t *inmemoryStorage) DoInTransaction(key []byte, cb func(entry *storage.Raw
 		Version: 0,
 	}
 
-	if obj, ok := t.cache.Get(string(key)); ok && obj != nil {
-		if b, ok := obj.([]byte); ok {
-			rawEntry.Value = b
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e, ok := t.lookup(k); ok {
+		value, err := t.decode(e)
+		if err != nil {
+			return err
 		}
+		rawEntry.Value = value
+		rawEntry.Version = e.Version
 	}
 
 	if !cb(rawEntry) {
 		return ErrCanceled
 	}
 
-	ttl := cache.NoExpiration
-	if rawEntry.Ttl > 0 {
-		ttl = time.Second * time.Duration(rawEntry.Ttl)
+	if err := t.writable(); err != nil {
+		return err
 	}
 
-	t.cache.Set(string(key), rawEntry.Value, ttl)
-	return nil
+	ttl := t.ttlOrDefault(rawEntry.Ttl)
+
+	return t.put(k, rawEntry.Value, t.versionOf(k) + 1, ttl)
+}
+
+// GetOrSet returns the existing value or stores the computed one, the flag tells if the value was computed.
+// Concurrent callers of the same key wait for a single compute, that must not access the storage.
+func (t *inmemoryStorage) GetOrSet(key []byte, ttlSeconds int, compute func() ([]byte, error)) ([]byte, bool, error) {
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e, ok := t.lookup(k); ok {
+		if t.limited() {
+			t.lru.touch(k)
+		}
+		value, err := t.decode(e)
+		return value, false, err
+	}
+
+	if err := t.writable(); err != nil {
+		return nil, false, err
+	}
+
+	value, err := compute()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := t.put(k, value, t.versionOf(k) + 1, t.ttlOrDefault(ttlSeconds)); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
 }
 
-func (t* inmemoryStorage) CompareAndSetRaw(key, value []byte, ttlSeconds int, version int64) (bool, error) {
-	return true, t.SetRaw(key, value, ttlSeconds)
+// CompareAndSetRaw stores the value only if the current version of the key equals to the given one, absent keys have version zero
+func (t* inmemoryStorage) CompareAndSetRaw(key, value []byte, ttlSeconds int, version int64) (updated bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("CompareAndSetRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	current := t.versionOf(k)
+	if current != version {
+		return false, nil
+	}
+
+	if err := t.put(k, value, current + 1, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (t* inmemoryStorage) RemoveRaw(key []byte) error {
-	t.cache.Delete(string(key))
-	return nil
+// CompareAndDeleteRaw removes the key only if its current version equals to the given one, returns false for absent keys
+func (t *inmemoryStorage) CompareAndDeleteRaw(key []byte, version int64) (deleted bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("CompareAndDeleteRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := t.lookup(k)
+	if !ok || e.Version != version {
+		return false, nil
+	}
+
+	t.delete(k, ReasonDeleted)
+	return true, nil
 }
 
-func (t* inmemoryStorage) getImpl(key []byte, required bool) ([]byte, error) {
+// SetIfAbsentRaw stores the value only if the key is absent or expired and returns true if it was stored
+func (t *inmemoryStorage) SetIfAbsentRaw(key, value []byte, ttlSeconds int) (stored bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SetIfAbsentRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
 
-	var val []byte
-	if obj, ok := t.cache.Get(string(key)); ok && obj != nil {
-		if b, ok := obj.([]byte); ok {
-			val = b
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := t.lookup(k); ok {
+		return false, nil
+	}
+
+	if err := t.put(k, value, t.versionOf(k)+1, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SwapRaw stores the value and returns the previous one with a flag if the key was present
+func (t *inmemoryStorage) SwapRaw(key, value []byte, ttlSeconds int) (old []byte, existed bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("SwapRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return nil, false, err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var version int64
+	e, existed := t.lookup(k)
+	if existed {
+		prev, err := t.decode(e)
+		if err != nil {
+			return nil, false, err
 		}
+		old, version = prev, e.Version
 	}
 
-	if val == nil && required {
-		return nil, os.ErrNotExist
+	if err := t.put(k, value, version+1, ttl); err != nil {
+		return nil, false, err
 	}
+	return old, existed, nil
+}
 
-	return val, nil
+// RenameRaw moves the entry with its value, remaining ttl, tags and version to the new key replacing an existing entry there,
+// returns false if the old key is absent
+func (t *inmemoryStorage) RenameRaw(oldKey, newKey []byte) (renamed bool, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("RenameRaw", oldKey, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	from, to := t.rawKey(oldKey), t.rawKey(newKey)
+
+	unlock := t.locks.lockAll(from, to)
+	defer unlock()
+
+	e, ok := t.lookup(from)
+	if !ok {
+		return false, nil
+	}
+	if from == to {
+		return true, nil
+	}
+
+	value, err := t.decode(e)
+	if err != nil {
+		return false, err
+	}
+	if err := t.checkEntry(newKey, value); err != nil {
+		return false, err
+	}
+	if err := t.checkSize(to, e.Value); err != nil {
+		return false, err
+	}
+
+	// the version never goes back for the new key
+	version := e.Version
+	if current := t.versionOf(to); current >= version {
+		version = current + 1
+	}
+
+	t.store(to, &entry{lastAccess: t.conf.Clock.Now().UnixNano(), Value: e.Value, Version: version, Expiration: e.Expiration, Compressed: e.Compressed, Meta: e.Meta})
+	t.delete(from, ReasonDeleted)
+	return true, nil
 }
 
-func (t* inmemoryStorage) EnumerateRaw(prefix, seek []byte, batchSize int, onlyKeys bool, cb func(entry *storage.RawEntry) bool) error {
+// IncrementRaw atomically adds delta to the counter stored as big endian int64, absent key is created with initial+delta
+func (t *inmemoryStorage) IncrementRaw(key []byte, delta, initial int64, ttlSeconds int) (counter int64, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("IncrementRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
 
-	prefixStr := string(prefix)
-	seekStr := string(seek)
+	ttl := t.ttlOrDefault(ttlSeconds)
 
-	for key, item := range t.cache.Items() {
+	k := t.rawKey(key)
 
-		if val, ok := item.Object.([]byte); ok && strings.HasPrefix(key, prefixStr) && key >= seekStr {
-			re := storage.RawEntry{
-				Key:     []byte(key),
-				Ttl:     int(item.Expiration),
-				Version: item.Expiration,
-			}
-			if !onlyKeys {
-				re.Value = val
-			}
-			if !cb(&re) {
-				break
-			}
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	counter = initial
+	var version int64
+	if e, ok := t.lookup(k); ok {
+		value, err := t.decode(e)
+		if err != nil {
+			return 0, err
+		}
+		if len(value) != 8 {
+			return 0, ErrNotCounter
 		}
+		counter = int64(binary.BigEndian.Uint64(value))
+		version = e.Version
+	}
 
+	counter += delta
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(counter))
+	if err := t.put(k, value, version + 1, ttl); err != nil {
+		return 0, err
 	}
+	return counter, nil
+}
 
-	return nil
+// AppendRaw appends the suffix to the value of the key creating it if absent and returns the new value,
+// the ttl is refreshed by the argument like in SetRaw
+func (t *inmemoryStorage) AppendRaw(key, suffix []byte, ttlSeconds int) (appended []byte, err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("AppendRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return nil, err
+	}
+
+	ttl := t.ttlOrDefault(ttlSeconds)
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var prev []byte
+	var version int64
+	if e, ok := t.lookup(k); ok {
+		value, err := t.decode(e)
+		if err != nil {
+			return nil, err
+		}
+		prev = value
+		version = e.Version
+	}
+
+	// the stored value is never extended in place, readers may hold it
+	value := make([]byte, len(prev)+len(suffix))
+	copy(value, prev)
+	copy(value[len(prev):], suffix)
+	if err := t.put(k, value, version+1, ttl); err != nil {
+		return nil, err
+	}
+	if t.conf.CopyOnRead && !t.conf.CopyOnWrite {
+		return append([]byte(nil), value...), nil
+	}
+	return value, nil
 }
 
-func (t* inmemoryStorage) Compact(discardRatio float64) error {
-	t.cache.DeleteExpired()
+func (t* inmemoryStorage) RemoveRaw(key []byte) (err error) {
+	if t.conf.MetricsHook != nil {
+		defer t.observe("RemoveRaw", key, time.Now(), &err)
+	}
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	t.delete(k, ReasonDeleted)
 	return nil
 }
 
-func (t* inmemoryStorage) Backup(w io.Writer, since uint64) (uint64, error) {
-	return 0, t.cache.Save(w)
+func (t* inmemoryStorage) getImpl(key []byte, ttlPtr *int, versionPtr *int64, required bool) ([]byte, error) {
+
+	val, found, err := t.getFound(key, ttlPtr, versionPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && required {
+		return nil, ErrNotFound
+	}
+
+	return val, nil
+}
+
+// getFound looks up the key tracking its presence separately from the value that could be empty
+func (t *inmemoryStorage) getFound(key []byte, ttlPtr *int, versionPtr *int64) ([]byte, bool, error) {
+
+	k := t.rawKey(key)
+
+	if e, ok := t.lookup(k); ok {
+		t.stats.hit()
+		value, err := t.decode(e)
+		if err != nil {
+			return nil, false, err
+		}
+		atomic.StoreInt64(&e.lastAccess, t.conf.Clock.Now().UnixNano())
+		if t.limited() {
+			t.lru.touch(k)
+		}
+		if ttlPtr != nil {
+			*ttlPtr = ttlSeconds(e.ttl(t.conf.Clock.Now()))
+		}
+		if versionPtr != nil {
+			*versionPtr = e.Version
+		}
+		return value, true, nil
+	}
+
+	t.stats.miss()
+	if obj, found := t.shards.of(k).Get(k); found {
+		if _, ok := asEntry(obj); !ok {
+			// written to the cache directly bypassing the storage
+			return nil, false, fmt.Errorf("%w: key %q holds %T", ErrTypeMismatch, key, obj)
+		}
+	}
+	return nil, false, nil
+}
+
+// Touch updates expiration of an existing entry without rewriting the value, ttlSeconds <= 0 means no expiration
+func (t *inmemoryStorage) Touch(key []byte, ttlSeconds int) (bool, error) {
+
+	if err := t.writable(); err != nil {
+		return false, err
+	}
+
+	k := t.rawKey(key)
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := t.lookup(k)
+	if !ok {
+		return false, nil
+	}
+
+	touched := &entry{lastAccess: atomic.LoadInt64(&e.lastAccess), Value: e.Value, Version: e.Version, Expiration: t.expiration(ttlDuration(ttlSeconds)), Compressed: e.Compressed, Meta: e.Meta}
+	t.freeze.enter()
+	t.view.RLock()
+	touched.Modified = atomic.AddUint64(&t.modSeq, 1)
+	t.shards.of(k).Set(k, touched, cache.NoExpiration)
+	t.view.RUnlock()
+	t.freeze.leave()
+	if t.limited() {
+		t.lru.touch(k)
+	}
+	return true, nil
 }
 
-func (t* inmemoryStorage) Restore(src io.Reader) error {
-	return t.cache.Load(src)
+// NeverExpires is returned by TTL for entries without expiration
+const NeverExpires time.Duration = -1
+
+// NeverExpiresTTL is the ttl in seconds reported by GetRaw and enumeration for entries without expiration,
+// zero means the entry is about to expire and positive values are remaining seconds rounded up
+const NeverExpiresTTL = -1
+
+// TTL returns remaining time before the entry expires or NeverExpires, and a flag if the key is present
+func (t *inmemoryStorage) TTL(key []byte) (time.Duration, bool, error) {
+
+	e, ok := t.lookup(t.rawKey(key))
+	if !ok {
+		return 0, false, nil
+	}
+	return e.ttl(t.conf.Clock.Now()), true, nil
+}
+
+// LastAccess returns the time of the last get or set of the key by the storage clock, and a flag if the key is present.
+// Touch keeps the time, entries written to the cache directly report zero time
+func (t *inmemoryStorage) LastAccess(key []byte) (time.Time, bool, error) {
+
+	e, ok := t.lookup(t.rawKey(key))
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if nanos := atomic.LoadInt64(&e.lastAccess); nanos > 0 {
+		return time.Unix(0, nanos), true, nil
+	}
+	return time.Time{}, true, nil
 }
 
+// Exists returns true if the key is present and not expired without copying the value
+func (t *inmemoryStorage) Exists(key []byte) (bool, error) {
+	_, ok := t.lookup(t.rawKey(key))
+	return ok, nil
+}
+
+// ttlSeconds returns remaining whole seconds rounded up, NeverExpiresTTL for entries without expiration
+func ttlSeconds(left time.Duration) int {
+	if left == NeverExpires {
+		return NeverExpiresTTL
+	}
+	if left <= 0 {
+		return 0
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
+// Compact removes expired entries and then evicts up to discardRatio fraction of remaining entries in the order of the eviction policy,
+// zero ratio only removes expired entries and ratio 1 or above evicts all of them, in read-only mode nothing is removed
+func (t* inmemoryStorage) Compact(discardRatio float64) error {
+	if err := t.writable(); err != nil {
+		return err
+	}
+
+	t.deleteExpired()
+	if discardRatio <= 0 {
+		return nil
+	}
+
+	if discardRatio > 1 {
+		discardRatio = 1
+	}
+	n := int(float64(t.lru.len()) * discardRatio)
+	for _, k := range t.lru.oldest(n) {
+		mu := t.locks.of(k)
+		mu.Lock()
+		t.delete(k, ReasonCapacity)
+		mu.Unlock()
+	}
+	return nil
+}
+
+// DropAll removes all entries and resets SizeBytes and key indexes, concurrent writes wait so indexes never keep dropped keys.
+// Operation counters of Stats are cumulative and are not reset
 func (t* inmemoryStorage) DropAll() error {
-	t.cache.Flush()
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+	if t.ns != "" {
+		// other storages could share the cache
+		return t.DropWithPrefix(nil)
+	}
+	t.freeze.enter()
+	t.view.Lock()
+	t.shards.flush()
+	t.lru.reset()
+	t.view.Unlock()
+	t.freeze.leave()
 	return nil
 }
 
 func (t* inmemoryStorage) DropWithPrefix(prefix []byte) error {
 
-	prefixStr := string(prefix)
+	if err := t.writable(); err != nil {
+		return err
+	}
 
-	for key, _ := range t.cache.Items() {
+	prefixStr := t.rawKey(prefix)
 
-		if strings.HasPrefix(key, prefixStr){
-			t.cache.Delete(key)
-		}
+	// walk the key index instead of copying the whole cache, keys are deleted after the walk releases the index
+	var keys []string
+	t.lru.forEachPrefix(prefixStr, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
 
+	for _, key := range keys {
+		t.delete(key, ReasonDeleted)
 	}
 
 	return nil
 
 }
 
+// RemoveIf removes entries for which the predicate returns true and returns their number, the predicate is called
+// under the lock of the key with the current value, so it must not access the storage
+func (t *inmemoryStorage) RemoveIf(predicate func(key, value []byte) bool) (int, error) {
+
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	t.lru.forEachPrefix(t.ns, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	cnt := 0
+	for _, key := range keys {
+		removed, err := t.removeIf(key, predicate)
+		if err != nil {
+			return cnt, err
+		}
+		if removed {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+func (t *inmemoryStorage) removeIf(k string, predicate func(key, value []byte) bool) (bool, error) {
+
+	mu := t.locks.of(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := t.lookup(k)
+	if !ok {
+		return false, nil
+	}
+	value, err := t.decode(e)
+	if err != nil {
+		return false, err
+	}
+	if !predicate([]byte(t.userKey(k)), value) {
+		return false, nil
+	}
+	t.delete(k, ReasonDeleted)
+	return true, nil
+}
+
+// Instance returns the underlying cache or the slice of caches of a sharded storage, nil with WithSealedInstance.
+// It is unsafe: entries written to the caches directly bypass versions, indexes, size limits and namespaces of the storage
 func (t* inmemoryStorage) Instance() interface{} {
-	return t.cache
+	if t.conf.SealedInstance {
+		return nil
+	}
+	if len(t.shards) == 1 {
+		return t.shards[0]
+	}
+	return []*cache.Cache(t.shards)
+}
+
+// Cache returns the underlying cache, nil for sharded storages or with WithSealedInstance.
+// It is unsafe: entries written to the cache directly bypass versions, indexes, size limits and namespaces of the storage
+func (t *inmemoryStorage) Cache() *cache.Cache {
+	if t.conf.SealedInstance || len(t.shards) != 1 {
+		return nil
+	}
+	return t.shards[0]
 }
@@ -0,0 +1,911 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"go.arpabet.com/storage"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t testing.TB, options ...Option) *inmemoryStorage {
+	s, err := NewE(t.Name(), options...)
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Destroy()
+	})
+	return s.(*inmemoryStorage)
+}
+
+func TestPrefixNotModified(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	backing := []byte("user:XXXX")
+	prefix := backing[:5]
+
+	if err := s.SetMulti(prefix, map[string][]byte{"a": []byte("1"), "bb": []byte("2")}, 0); err != nil {
+		t.Fatalf("set multi: %v", err)
+	}
+	values, err := s.GetMulti(prefix, [][]byte{[]byte("a"), []byte("bb")})
+	if err != nil {
+		t.Fatalf("get multi: %v", err)
+	}
+
+	if !bytes.Equal(backing, []byte("user:XXXX")) {
+		t.Fatalf("prefix backing array modified: %q", backing)
+	}
+	if string(values["a"]) != "1" || string(values["bb"]) != "2" {
+		t.Fatalf("unexpected values %q", values)
+	}
+	if _, err := s.GetRaw([]byte("user:bb"), nil, nil, true); err != nil {
+		t.Fatalf("key is not prefixed: %v", err)
+	}
+}
+
+func TestGetRawTTLAndVersion(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	key := []byte("k")
+	if err := s.SetRaw(key, []byte("v"), 30); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRaw(key, []byte("v2"), 30); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	var ttl int
+	var version int64
+	value, err := s.GetRaw(key, &ttl, &version, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(value) != "v2" {
+		t.Fatalf("unexpected value %q", value)
+	}
+	if ttl < 29 || ttl > 30 {
+		t.Fatalf("ttl %d is out of [29, 30]", ttl)
+	}
+	if version != 2 {
+		t.Fatalf("version %d, expected 2", version)
+	}
+}
+
+func TestDoInTransactionConcurrentIncrements(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	const goroutines, increments = 16, 200
+	key := []byte("counter")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := s.DoInTransaction(key, func(entry *storage.RawEntry) bool {
+					var counter uint64
+					if len(entry.Value) == 8 {
+						counter = binary.BigEndian.Uint64(entry.Value)
+					}
+					entry.Value = make([]byte, 8)
+					binary.BigEndian.PutUint64(entry.Value, counter+1)
+					return true
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	var version int64
+	value, err := s.GetRaw(key, nil, &version, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if counter := binary.BigEndian.Uint64(value); counter != goroutines*increments {
+		t.Fatalf("counter %d, expected %d", counter, goroutines*increments)
+	}
+	if version != goroutines*increments {
+		t.Fatalf("version %d, expected %d", version, goroutines*increments)
+	}
+}
+
+func TestLenAfterDropAll(t *testing.T) {
+
+	s := newTestStorage(t)
+	if n := s.Len(); n != 0 {
+		t.Fatalf("len %d of a new storage", n)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.SetRaw([]byte(key), []byte(key), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if n := s.Len(); n != 3 {
+		t.Fatalf("len %d, expected 3", n)
+	}
+
+	if err := s.DropAll(); err != nil {
+		t.Fatalf("drop all: %v", err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("len %d after DropAll", n)
+	}
+}
+
+// manualClock is the storage clock moved only by tests
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestExistsAfterExpiration(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if ok, err := s.Exists([]byte("k")); ok || err != nil {
+		t.Fatalf("absent key exists %v, error %v", ok, err)
+	}
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 10); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if ok, err := s.Exists([]byte("k")); !ok || err != nil {
+		t.Fatalf("key exists %v, error %v", ok, err)
+	}
+
+	clock.Advance(11 * time.Second)
+	if ok, err := s.Exists([]byte("k")); ok || err != nil {
+		t.Fatalf("expired key exists %v, error %v", ok, err)
+	}
+}
+
+func TestTouchExtendsExpiration(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 10); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	clock.Advance(9 * time.Second)
+
+	if ok, err := s.Touch([]byte("k"), 10); !ok || err != nil {
+		t.Fatalf("touch %v, error %v", ok, err)
+	}
+	if ok, err := s.Touch([]byte("absent"), 10); ok || err != nil {
+		t.Fatalf("touch of absent key %v, error %v", ok, err)
+	}
+
+	// past the original deadline
+	clock.Advance(5 * time.Second)
+	value, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil {
+		t.Fatalf("touched key is gone: %v", err)
+	}
+	if string(value) != "v" {
+		t.Fatalf("unexpected value %q", value)
+	}
+
+	clock.Advance(6 * time.Second)
+	if ok, _ := s.Exists([]byte("k")); ok {
+		t.Fatalf("key survived the new deadline")
+	}
+}
+
+func TestGetOrSetComputesOnce(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	const goroutines = 32
+	var computed int32
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	values := make([][]byte, goroutines)
+	errs := make([]error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			values[i], _, errs[i] = s.GetOrSet([]byte("k"), 0, func() ([]byte, error) {
+				atomic.AddInt32(&computed, 1)
+				time.Sleep(time.Millisecond)
+				return []byte("computed"), nil
+			})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&computed); n != 1 {
+		t.Fatalf("computed %d times", n)
+	}
+	for i := range values {
+		if errs[i] != nil {
+			t.Fatalf("get or set: %v", errs[i])
+		}
+		if string(values[i]) != "computed" {
+			t.Fatalf("caller %d got %q", i, values[i])
+		}
+	}
+}
+
+func TestReadOnlyBlocksWrites(t *testing.T) {
+
+	s := newTestStorage(t)
+	other := newTestStorage(t)
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	s.SetReadOnly(true)
+
+	key, value := []byte("k"), []byte("v")
+	writes := map[string]func() error{
+		"SetRaw":              func() error { return s.SetRaw(key, value, 0) },
+		"SetRawAt":            func() error { return s.SetRawAt(key, value, time.Now().Add(time.Hour)) },
+		"SetRawWithMeta":      func() error { return s.SetRawWithMeta(key, value, 0, map[string]string{"a": "b"}) },
+		"SetIfAbsentRaw":      func() error { _, err := s.SetIfAbsentRaw([]byte("new"), value, 0); return err },
+		"SwapRaw":             func() error { _, _, err := s.SwapRaw(key, value, 0); return err },
+		"CompareAndSetRaw":    func() error { _, err := s.CompareAndSetRaw(key, value, 0, 1); return err },
+		"CompareAndDeleteRaw": func() error { _, err := s.CompareAndDeleteRaw(key, 1); return err },
+		"IncrementRaw":        func() error { _, err := s.IncrementRaw([]byte("n"), 1, 0, 0); return err },
+		"AppendRaw":           func() error { _, err := s.AppendRaw(key, value, 0); return err },
+		"SetBitRaw":           func() error { _, err := s.SetBitRaw(key, 1, true); return err },
+		"RenameRaw":           func() error { _, err := s.RenameRaw(key, []byte("renamed")); return err },
+		"Touch":               func() error { _, err := s.Touch(key, 10); return err },
+		"RemoveRaw":           func() error { return s.RemoveRaw(key) },
+		"RemoveIf":            func() error { _, err := s.RemoveIf(func(key, value []byte) bool { return true }); return err },
+		"DropAll":             func() error { return s.DropAll() },
+		"DropWithPrefix":      func() error { return s.DropWithPrefix(key) },
+		"DropWithTag":         func() error { _, err := s.DropWithTag("a", "b"); return err },
+		"Compact":             func() error { return s.Compact(1) },
+		"GetOrSet": func() error {
+			_, _, err := s.GetOrSet([]byte("new"), 0, func() ([]byte, error) { return value, nil })
+			return err
+		},
+		"DoInTransaction": func() error {
+			return s.DoInTransaction(key, func(entry *storage.RawEntry) bool { return true })
+		},
+		"DoInMultiTransaction": func() error {
+			return s.DoInMultiTransaction([][]byte{key}, func(map[string]*storage.RawEntry) bool { return true })
+		},
+		"SetMulti":      func() error { return s.SetMulti(nil, map[string][]byte{"k": value}, 0) },
+		"RemoveMulti":   func() error { return s.RemoveMulti(nil, [][]byte{key}) },
+		"Lock":          func() error { _, _, err := s.Lock([]byte("lock"), time.Minute); return err },
+		"Unlock":        func() error { _, err := s.Unlock([]byte("lock"), "token"); return err },
+		"Merge":         func() error { return s.Merge(other, true) },
+		"Restore":       func() error { return s.Restore(strings.NewReader("")) },
+		"RestoreStream": func() error { return s.RestoreStream(strings.NewReader("")) },
+		"ImportJSON":    func() error { return s.ImportJSON(strings.NewReader("[]")) },
+		"LoadPairs":     func() error { _, err := s.LoadPairs(strings.NewReader("")); return err },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%s returned %v in read-only mode", name, err)
+		}
+	}
+
+	value, err := s.GetRaw(key, nil, nil, true)
+	if err != nil || string(value) != "v" {
+		t.Fatalf("read in read-only mode returned %q, %v", value, err)
+	}
+
+	s.SetReadOnly(false)
+	if err := s.SetRaw(key, []byte("v2"), 0); err != nil {
+		t.Fatalf("set after read-only mode: %v", err)
+	}
+}
+
+func TestReadOnlyCompactKeepsEntries(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock), WithCleanupInterval(0))
+	if err := s.SetRaw([]byte("expiring"), []byte("v"), 1); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	clock.Advance(time.Minute)
+	s.SetReadOnly(true)
+
+	for _, ratio := range []float64{0, 1} {
+		if err := s.Compact(ratio); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("compact %v returned %v in read-only mode", ratio, err)
+		}
+	}
+	if n := s.lru.len(); n != 2 {
+		t.Fatalf("read-only compact left %d of 2 entries", n)
+	}
+}
+
+func BenchmarkDropWithPrefixSmall(b *testing.B) {
+
+	for _, options := range [][]Option{nil, {WithPrefixIndex()}} {
+		name := "scan"
+		if options != nil {
+			name = "index"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestStorage(b, options...)
+			for i := 0; i < 100000; i++ {
+				if err := s.SetRaw([]byte(fmt.Sprintf("bulk:%06d", i)), []byte("v"), 0); err != nil {
+					b.Fatalf("set: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 10; j++ {
+					if err := s.SetRaw([]byte(fmt.Sprintf("drop:%d", j)), []byte("v"), 0); err != nil {
+						b.Fatalf("set: %v", err)
+					}
+				}
+				b.StartTimer()
+				if err := s.DropWithPrefix([]byte("drop:")); err != nil {
+					b.Fatalf("drop: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSizeBytes(t *testing.T) {
+
+	s := newTestStorage(t)
+	if size := s.SizeBytes(); size != 0 {
+		t.Fatalf("size %d of a new storage", size)
+	}
+
+	if err := s.SetRaw([]byte("key"), make([]byte, 100), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if size := s.SizeBytes(); size != 3+100+EntryOverhead {
+		t.Fatalf("size %d after one entry", size)
+	}
+
+	if err := s.SetRaw([]byte("key2"), make([]byte, 50), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// overwrite replaces the size of the entry
+	if err := s.SetRaw([]byte("key"), make([]byte, 10), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if size := s.SizeBytes(); size != 3+10+4+50+2*EntryOverhead {
+		t.Fatalf("size %d after overwrite", size)
+	}
+
+	if err := s.RemoveRaw([]byte("key")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if size := s.SizeBytes(); size != 4+50+EntryOverhead {
+		t.Fatalf("size %d after remove", size)
+	}
+	if err := s.RemoveRaw([]byte("key2")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if size := s.SizeBytes(); size != 0 {
+		t.Fatalf("size %d of an empty storage", size)
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+
+	s := newTestStorage(t)
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	var version int64
+	if _, err := s.GetRaw([]byte("k"), nil, &version, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if deleted, err := s.CompareAndDeleteRaw([]byte("k"), version+1); deleted || err != nil {
+		t.Fatalf("mismatching version deleted %v, error %v", deleted, err)
+	}
+	if ok, _ := s.Exists([]byte("k")); !ok {
+		t.Fatalf("key is deleted by a mismatching version")
+	}
+
+	if deleted, err := s.CompareAndDeleteRaw([]byte("k"), version); !deleted || err != nil {
+		t.Fatalf("matching version deleted %v, error %v", deleted, err)
+	}
+	if ok, _ := s.Exists([]byte("k")); ok {
+		t.Fatalf("key survived a matching version")
+	}
+}
+
+func TestSetIfAbsentSingleWinner(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	const goroutines = 32
+	var winners int32
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			stored, err := s.SetIfAbsentRaw([]byte("k"), []byte(fmt.Sprint(i)), 0)
+			if err != nil {
+				t.Errorf("set if absent: %v", err)
+			}
+			if stored {
+				atomic.AddInt32(&winners, 1)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&winners); n != 1 {
+		t.Fatalf("%d winners", n)
+	}
+	var version int64
+	if _, err := s.GetRaw([]byte("k"), nil, &version, true); err != nil || version != 1 {
+		t.Fatalf("version %d, error %v", version, err)
+	}
+}
+
+func TestSwapReturnsPrevious(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	old, existed, err := s.SwapRaw([]byte("k"), []byte("first"), 0)
+	if err != nil || existed || old != nil {
+		t.Fatalf("swap of absent key returned %q, %v, %v", old, existed, err)
+	}
+
+	old, existed, err = s.SwapRaw([]byte("k"), []byte("second"), 0)
+	if err != nil || !existed || string(old) != "first" {
+		t.Fatalf("swap of present key returned %q, %v, %v", old, existed, err)
+	}
+
+	value, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(value) != "second" {
+		t.Fatalf("stored %q, %v", value, err)
+	}
+}
+
+func TestForeignObjectInCache(t *testing.T) {
+
+	s := newTestStorage(t)
+	s.Cache().Set("foreign", 42, cache.NoExpiration)
+
+	if _, err := s.GetRaw([]byte("foreign"), nil, nil, false); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("get of a foreign object returned %v", err)
+	}
+	if _, _, err := s.GetRawFound([]byte("foreign")); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("get found of a foreign object returned %v", err)
+	}
+}
+
+func TestTTLCases(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRaw([]byte("forever"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRaw([]byte("expiring"), []byte("v"), 10); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	if ttl, ok, err := s.TTL([]byte("forever")); ttl != NeverExpires || !ok || err != nil {
+		t.Fatalf("ttl of a key without expiration %v, %v, %v", ttl, ok, err)
+	}
+	if ttl, ok, err := s.TTL([]byte("expiring")); ttl != 10*time.Second || !ok || err != nil {
+		t.Fatalf("ttl of an expiring key %v, %v, %v", ttl, ok, err)
+	}
+	if _, ok, err := s.TTL([]byte("absent")); ok || err != nil {
+		t.Fatalf("ttl of an absent key %v, %v", ok, err)
+	}
+
+	var ttl int
+	if _, err := s.GetRaw([]byte("forever"), &ttl, nil, true); err != nil || ttl != NeverExpiresTTL {
+		t.Fatalf("GetRaw ttl of a key without expiration %d, %v", ttl, err)
+	}
+	clock.Advance(9500 * time.Millisecond)
+	// remaining seconds are rounded up, zero is reserved for entries about to expire
+	if _, err := s.GetRaw([]byte("expiring"), &ttl, nil, true); err != nil || ttl != 1 {
+		t.Fatalf("GetRaw ttl of an expiring key %d, %v", ttl, err)
+	}
+}
+
+func TestSetRawAt(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRawAt([]byte("future"), []byte("v"), clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("set with a future deadline: %v", err)
+	}
+	if ttl, ok, _ := s.TTL([]byte("future")); !ok || ttl != time.Minute {
+		t.Fatalf("ttl %v, present %v", ttl, ok)
+	}
+
+	if err := s.SetRaw([]byte("past"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRawAt([]byte("past"), []byte("v2"), clock.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("set with a past deadline: %v", err)
+	}
+	if ok, _ := s.Exists([]byte("past")); ok {
+		t.Fatalf("a past deadline kept the key")
+	}
+
+	clock.Advance(time.Minute)
+	if ok, _ := s.Exists([]byte("future")); ok {
+		t.Fatalf("key outlived its deadline")
+	}
+}
+
+func TestDeleteExpiredCollect(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock), WithCleanupInterval(0))
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 1); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := s.SetRaw([]byte("long"), []byte("v"), 60); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if expired := s.DeleteExpiredCollect(); len(expired) != 0 {
+		t.Fatalf("collected %q before expiration", expired)
+	}
+
+	clock.Advance(2 * time.Second)
+	var keys []string
+	for _, key := range s.DeleteExpiredCollect() {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("collected %q", keys)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("len %d after the sweep", n)
+	}
+	if expired := s.DeleteExpiredCollect(); len(expired) != 0 {
+		t.Fatalf("collected %q twice", expired)
+	}
+}
+
+func TestCompactRatio(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock), WithCleanupInterval(0))
+
+	for i := 0; i < 8; i++ {
+		if err := s.SetRaw([]byte(fmt.Sprintf("key%d", i)), []byte("v"), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	for _, key := range []string{"expired1", "expired2"} {
+		if err := s.SetRaw([]byte(key), []byte("v"), 1); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	clock.Advance(2 * time.Second)
+
+	// expired entries go first, then half of the remaining 8 in the order of eviction
+	if err := s.Compact(0.5); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if n := s.Len(); n != 4 {
+		t.Fatalf("len %d after compaction, expected 4", n)
+	}
+	for i := 0; i < 8; i++ {
+		ok, _ := s.Exists([]byte(fmt.Sprintf("key%d", i)))
+		if ok != (i >= 4) {
+			t.Fatalf("key%d present %v after compaction", i, ok)
+		}
+	}
+}
+
+func TestRenameRaw(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRaw([]byte("old"), []byte("v"), 60); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	clock.Advance(10 * time.Second)
+
+	if renamed, err := s.RenameRaw([]byte("old"), []byte("new")); !renamed || err != nil {
+		t.Fatalf("rename of present key %v, %v", renamed, err)
+	}
+	if ok, _ := s.Exists([]byte("old")); ok {
+		t.Fatalf("old key is still present")
+	}
+	if ttl, ok, _ := s.TTL([]byte("new")); !ok || ttl != 50*time.Second {
+		t.Fatalf("ttl %v of the renamed key, present %v", ttl, ok)
+	}
+
+	if renamed, err := s.RenameRaw([]byte("absent"), []byte("other")); renamed || err != nil {
+		t.Fatalf("rename of absent key %v, %v", renamed, err)
+	}
+	if ok, _ := s.Exists([]byte("other")); ok {
+		t.Fatalf("rename of absent key created the target")
+	}
+}
+
+func TestRenameRawSizeLimit(t *testing.T) {
+
+	const limit = 300
+	s := newTestStorage(t, WithMaxMemoryBytes(limit))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	long := bytes.Repeat([]byte{'k'}, limit)
+	if renamed, err := s.RenameRaw([]byte("k"), long); renamed || !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("rename to the oversized entry %v, %v", renamed, err)
+	}
+	if ok, _ := s.Exists([]byte("k")); !ok {
+		t.Fatalf("failed rename removed the old key")
+	}
+	if size := s.SizeBytes(); size > limit {
+		t.Fatalf("size %d above the limit %d", size, limit)
+	}
+}
+
+func TestDropAllResets(t *testing.T) {
+
+	s := newTestStorage(t, WithPrefixIndex(), WithMaxEntries(1000))
+	fillKeys(t, s, 100)
+
+	if err := s.DropAll(); err != nil {
+		t.Fatalf("drop all: %v", err)
+	}
+
+	if n := s.Len(); n != 0 {
+		t.Fatalf("len %d after DropAll", n)
+	}
+	if size := s.SizeBytes(); size != 0 {
+		t.Fatalf("size %d after DropAll", size)
+	}
+	if n := s.lru.len(); n != 0 {
+		t.Fatalf("eviction list keeps %d keys", n)
+	}
+	if n := len(s.lru.sorted.keys); n != 0 {
+		t.Fatalf("prefix index keeps %d keys", n)
+	}
+	for i := range s.locks.stripes {
+		if n := len(s.locks.stripes[i].held); n != 0 {
+			t.Fatalf("stripe %d keeps %d key locks", i, n)
+		}
+	}
+
+	if n, _ := s.CountWithPrefix([]byte("key")); n != 0 {
+		t.Fatalf("prefix count %d after DropAll", n)
+	}
+}
+
+func TestNotFoundMatchesErrNotExist(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	_, err := s.GetRaw([]byte("absent"), nil, nil, true)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error %v does not match ErrNotFound", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error %v does not match os.ErrNotExist", err)
+	}
+
+	if value, err := s.GetRaw([]byte("absent"), nil, nil, false); value != nil || err != nil {
+		t.Fatalf("not required get returned %q, %v", value, err)
+	}
+}
+
+func TestLastAccessAdvances(t *testing.T) {
+
+	clock := newManualClock()
+	s := newTestStorage(t, WithClock(clock))
+
+	if err := s.SetRaw([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	written, ok, err := s.LastAccess([]byte("k"))
+	if !ok || err != nil || !written.Equal(clock.Now()) {
+		t.Fatalf("last access %v after write, %v, %v", written, ok, err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := s.GetRaw([]byte("k"), nil, nil, true); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	read, ok, err := s.LastAccess([]byte("k"))
+	if !ok || err != nil || !read.Equal(written.Add(time.Minute)) {
+		t.Fatalf("last access %v after read, %v, %v", read, ok, err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := s.GetMulti(nil, [][]byte{[]byte("k")}); err != nil {
+		t.Fatalf("get multi: %v", err)
+	}
+	if multi, _, _ := s.LastAccess([]byte("k")); !multi.Equal(read.Add(time.Minute)) {
+		t.Fatalf("last access %v after multi read", multi)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := s.RenameRaw([]byte("k"), []byte("renamed")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if renamed, ok, _ := s.LastAccess([]byte("renamed")); !ok || !renamed.Equal(clock.Now()) {
+		t.Fatalf("last access %v after rename", renamed)
+	}
+
+	if _, ok, _ := s.LastAccess([]byte("absent")); ok {
+		t.Fatalf("absent key has last access")
+	}
+}
+
+func TestRemoveIf(t *testing.T) {
+
+	s := newTestStorage(t)
+	values := map[string]string{"a": "clean", "b": "has\x00marker", "c": "\x00", "d": "also clean"}
+	for key, value := range values {
+		if err := s.SetRaw([]byte(key), []byte(value), 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	n, err := s.RemoveIf(func(key, value []byte) bool {
+		return bytes.IndexByte(value, 0) >= 0
+	})
+	if err != nil {
+		t.Fatalf("remove if: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("removed %d entries, expected 2", n)
+	}
+	for key, present := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if ok, _ := s.Exists([]byte(key)); ok != present {
+			t.Fatalf("key %q present %v, expected %v", key, ok, present)
+		}
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+
+	s := newTestStorage(t, WithCopyOnRead(true))
+	if err := s.SetRaw([]byte("k"), []byte("value"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	read, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	read[0] = 'X'
+
+	again, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(again) != "value" {
+		t.Fatalf("mutation of a returned slice changed the stored value to %q, %v", again, err)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+
+	s := newTestStorage(t, WithCopyOnWrite(true))
+	value := []byte("value")
+	if err := s.SetRaw([]byte("k"), value, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	value[0] = 'X'
+
+	read, err := s.GetRaw([]byte("k"), nil, nil, true)
+	if err != nil || string(read) != "value" {
+		t.Fatalf("mutation of the written slice changed the stored value to %q, %v", read, err)
+	}
+}
+
+func TestAppendConcurrently(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	const goroutines, appends = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			suffix := []byte{byte('a' + i)}
+			for j := 0; j < appends; j++ {
+				if _, err := s.AppendRaw([]byte("log"), suffix, 0); err != nil {
+					t.Errorf("append: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	value, err := s.GetRaw([]byte("log"), nil, nil, true)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(value) != goroutines*appends {
+		t.Fatalf("value of %d bytes, expected %d", len(value), goroutines*appends)
+	}
+	for i := 0; i < goroutines; i++ {
+		if n := bytes.Count(value, []byte{byte('a' + i)}); n != appends {
+			t.Fatalf("%d bytes of goroutine %d, expected %d", n, i, appends)
+		}
+	}
+}
+
+func TestGetRawFoundEmptyValue(t *testing.T) {
+
+	s := newTestStorage(t)
+	if err := s.SetRaw([]byte("empty"), []byte{}, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	value, found, err := s.GetRawFound([]byte("empty"))
+	if err != nil || !found || len(value) != 0 {
+		t.Fatalf("empty value %q, found %v, %v", value, found, err)
+	}
+
+	value, found, err = s.GetRawFound([]byte("absent"))
+	if err != nil || found || value != nil {
+		t.Fatalf("absent key %q, found %v, %v", value, found, err)
+	}
+}
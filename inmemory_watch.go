@@ -0,0 +1,96 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is the kind of change delivered to watchers
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventRemove
+	EventExpire
+)
+
+// Event describes a change of the key, Value is the new value for EventSet and the old one otherwise
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte
+}
+
+// watchBuffer is the capacity of watch channels, events are dropped when the consumer is behind
+const watchBuffer = 256
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// watchers keeps subscriptions, dropped is first to be 64-bit aligned for atomic access
+type watchers struct {
+	dropped uint64
+	mu      sync.RWMutex
+	list    map[*watcher]struct{}
+	cnt     int32
+}
+
+func (t *watchers) active() bool {
+	return atomic.LoadInt32(&t.cnt) > 0
+}
+
+func (t *watchers) add(prefix string) *watcher {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.list == nil {
+		t.list = make(map[*watcher]struct{})
+	}
+	t.list[w] = struct{}{}
+	atomic.AddInt32(&t.cnt, 1)
+	return w
+}
+
+func (t *watchers) remove(w *watcher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.list[w]; ok {
+		delete(t.list, w)
+		atomic.AddInt32(&t.cnt, -1)
+		close(w.ch)
+	}
+}
+
+// notify delivers the event to watchers of matching prefixes without blocking the writer
+func (t *watchers) notify(typ EventType, k string, value []byte) {
+	if !t.active() {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for w := range t.list {
+		if strings.HasPrefix(k, w.prefix) {
+			select {
+			case w.ch <- Event{Type: typ, Key: []byte(k), Value: value}:
+			default:
+				atomic.AddUint64(&t.dropped, 1)
+			}
+		}
+	}
+}
+
+// Watch subscribes to changes of keys with the prefix, events are dropped and counted in Stats when the channel is full.
+// The returned function unsubscribes and closes the channel.
+func (t *inmemoryStorage) Watch(prefix []byte) (<-chan Event, func()) {
+	w := t.watchers.add(string(prefix))
+	return w.ch, func() {
+		t.watchers.remove(w)
+	}
+}
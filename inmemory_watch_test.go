@@ -0,0 +1,51 @@
+/**
+  Copyright (c) 2022 Arpabet, LLC. All rights reserved.
+*/
+
+package inmemorystorage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchEvents(t *testing.T) {
+
+	s := newTestStorage(t)
+
+	events, cancel := s.Watch([]byte("p:"))
+
+	if err := s.SetRaw([]byte("p:a"), []byte("1"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRaw([]byte("q:a"), []byte("ignored"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetRaw([]byte("p:a"), []byte("2"), 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.RemoveRaw([]byte("p:a")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	expected := []Event{
+		{Type: EventSet, Key: []byte("p:a"), Value: []byte("1")},
+		{Type: EventSet, Key: []byte("p:a"), Value: []byte("2")},
+		{Type: EventRemove, Key: []byte("p:a"), Value: []byte("2")},
+	}
+	for i, want := range expected {
+		select {
+		case ev := <-events:
+			if ev.Type != want.Type || string(ev.Key) != string(want.Key) || string(ev.Value) != string(want.Value) {
+				t.Fatalf("event %d is %v %q=%q, expected %v %q=%q", i, ev.Type, ev.Key, ev.Value, want.Type, want.Key, want.Value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d is not delivered", i)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatalf("unexpected event after the last expected one")
+	}
+}